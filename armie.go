@@ -1,10 +1,15 @@
 package armie
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"time"
 	"net"
 	"io"
 	"fmt"
 	"bufio"
+	"runtime/debug"
 	"sync"
 	"github.com/ugorji/go/codec"
 	"errors"
@@ -13,19 +18,104 @@ import (
 
 const bufSize = 8192
 
-type transportConn struct {
+//
+// A socket produced by a Transport, and the address it was dialed
+// with (used in log messages).
+//
+type TransportConn struct {
 	Socket io.ReadWriteCloser
 	Address string
 }
 
-type transport interface {
-	Dial(address string) (*transportConn, error)
+//
+// Transport is the carrier beneath Server and Conn.  Dial connects to
+// an address and Listen accepts connections at one; addresses are
+// passed through unmodified, so their format is up to the Transport.
+// Frames are written to and read from the socket as a byte stream, so
+// any reliable, ordered carrier will do.
+//
+type Transport interface {
+	Dial(address string) (*TransportConn, error)
 	Listen(address string) (net.Listener, error)
 }
 
+//
+// Options for NewServer and Dial.  The zero value is usable.
+//
+type Options struct {
+	// Destination for log output.  Nil disables logging.
+	Logger io.Writer
+	// Run on each new Conn before it starts serving requests and
+	// events.  On a Server, OnConnection replaces it.
+	ConnectionHandler ConnectionHandler
+	// How inbound requests and events are dispatched to handlers.
+	// Defaults to DispatchInline.
+	Dispatch DispatchMode
+	// Worker goroutines per connection under DispatchPool, for
+	// requests and, unless OrderedEvents is set, as many again for
+	// events.  Default 8.
+	Workers int
+	// Requests and events waiting for a worker under DispatchPool,
+	// and events waiting under OrderedEvents.  Default 64.
+	QueueDepth int
+	// Deliver events to the EventHandler one at a time, in arrival
+	// order, even when requests are dispatched concurrently.
+	OrderedEvents bool
+	// Called after a RequestHandler or EventHandler panics, with the
+	// recovered value and the stack, so services can report it.  The
+	// panic is also logged, and a request is answered with a
+	// CodeInternal RemoteError.
+	PanicHandler PanicHandler
+	// Include the stack trace in the RemoteError sent for a panic.
+	SendPanicStack bool
+	// Initial interceptors, as if added with the Use methods of the
+	// Server or Conn being created.
+	RequestInterceptors     []RequestInterceptor
+	EventInterceptors       []EventInterceptor
+	ClientInterceptors      []ClientInterceptor
+	ClientEventInterceptors []ClientEventInterceptor
+	// Name and capabilities announced to the peer in the handshake.
+	// See PeerInfo.
+	Name         string
+	Capabilities []string
+	// How long to wait for the peer's hello.  Default 10 seconds.
+	HandshakeTimeout time.Duration
+	// Authenticates peers connecting to a Server.  See auth.go.
+	Authenticator Authenticator
+	// Answers the peer's Authenticator when dialing.
+	Credentials Credentials
+	// Restricts the requests and events each peer may send.
+	Policy *Policy
+	// Flow control windows granted to the peer, in bytes, for all
+	// events and stream messages together and for each stream.
+	// Default 1MiB and 256KiB; negative disables flow control.  See
+	// flow.go.
+	ConnWindow   int
+	StreamWindow int
+}
+
 type RequestHandler func(request *Request, response *Response)
 type EventHandler func(event *Event)
 type ConnectionHandler func(conn *Conn) error
+type CloseHandler func(conn *Conn, err error)
+type PanicHandler func(conn *Conn, method string, recovered interface{}, stack []byte)
+
+//
+// Requester is implemented by Conn and ReconnectingConn, so code
+// that only issues requests (like generated client stubs) works
+// with either.
+//
+type Requester interface {
+	SendRequest(method string, args ...interface{}) (*Future, error)
+	SendRequestContext(ctx context.Context, method string, args ...interface{}) (*Future, error)
+}
+
+//
+// ErrConnectionClosed is returned by (and wrapped in) the errors of
+// every Future pending when a connection is lost or closed.  Use
+// errors.Is to test for it.
+//
+var ErrConnectionClosed = errors.New("connection closed")
 
 //
 // Server provides a Listen(addr) method for accepting new connections.
@@ -38,19 +128,41 @@ type Server struct {
 	logger       *log.Logger
 	addr         string
 	shutdown     bool
-	transport    transport
+	transport    Transport
+	opts         Options
 	connHandler  ConnectionHandler
 	listener     net.Listener
-	shutdownChan chan int
+	mu           sync.Mutex
+	conns        map[*Conn]struct{}
+	services     *registry
+	interceptors *interceptors
+	subs         *subscriptions
+	shutdownChan chan struct{}
 }
 
-func newServer(logout io.Writer, transport transport) *Server {
-	return &Server{
-		logger:       log.New(logout),
+//
+// Create a Server that accepts connections over the given Transport.
+// opts may be nil.
+//
+func NewServer(transport Transport, opts *Options) *Server {
+	if opts == nil {
+		opts = &Options{}
+	}
+	serv := &Server{
+		logger:       log.New(opts.Logger),
 		transport:    transport,
+		opts:         *opts,
+		connHandler:  opts.ConnectionHandler,
 		shutdown:     false,
-		shutdownChan: make(chan int),
+		conns:        make(map[*Conn]struct{}),
+		services:     newRegistry(),
+		interceptors: newInterceptors(opts),
+		subs:         newSubscriptions(),
+		shutdownChan: make(chan struct{}),
 	}
+	serv.services.registerHandler(subscribeMethod, serv.handleSubscribe)
+	serv.services.registerHandler(unsubscribeMethod, serv.handleUnsubscribe)
+	return serv
 }
 
 //
@@ -75,14 +187,38 @@ func (serv *Server) Listen(addr string) error {
 		return fmt.Errorf("[RPC] Could not bind on " + addr)
 	}
 
+	serv.ListenOn(ln)
+
+	return nil
+}
+
+//
+// Accept connections from an existing listener, such as a
+// WebSocketListener mounted on an http.ServeMux.  Like Listen,
+// ListenOn returns immediately; Close stops it and closes ln.
+//
+func (serv *Server) ListenOn(ln net.Listener) {
+
+	if serv.addr == "" {
+		serv.addr = ln.Addr().String()
+	}
+	addr := serv.addr
+
+	serv.mu.Lock()
+	serv.listener = ln
+	serv.mu.Unlock()
+
 	serv.logger.Info("[RPC] Listening on %s for RPC connections", addr)
 
 	go func() {
-		for !serv.shutdown {
+		for {
 			con, err := ln.Accept()
 
-			if serv.shutdown {
+			if serv.isShutdown() {
 				serv.logger.Info("[RPC] Shutting down listener on %s", addr)
+				if con != nil {
+					con.Close()
+				}
 				break
 			}
 
@@ -91,49 +227,148 @@ func (serv *Server) Listen(addr string) error {
 				break
 			}
 
-			bw := bufio.NewWriterSize(con, bufSize)
-			br := bufio.NewReaderSize(con, bufSize)
-
-			c := &Conn{
-				Alive: true,
-				conn: con,
-				outstanding: make(map[uint64]*Future),
-				logger: serv.logger,
-				bw: bw,
-				br: br,
-				dec: codec.NewDecoder(br, &mph),
-				enc: codec.NewEncoder(bw, &mph),
-				addr: con.RemoteAddr().String(),
-			}
+			c := newConnection(con, con.RemoteAddr().String(), serv.logger, &serv.opts)
+			c.serverServices = serv.services
+			c.serverInterceptors = serv.interceptors
 
-			err = serv.connHandler(c)
-			if err != nil {
-				serv.logger.Error("[RPC] initializing connection on %s: %v", addr, err)
-				con.Close()
-				continue
-			}
-
-			go c.serve()
+			go serv.setup(c, addr)
 		}
 
 		ln.Close()
-		serv.shutdownChan <- 1
+		close(serv.shutdownChan)
 	}()
+}
 
-	return nil
+//
+// Handshake with a new Conn and run the ConnectionHandler, then serve
+// it.  Peers failing the handshake never reach the ConnectionHandler.
+//
+func (serv *Server) setup(c *Conn, addr string) {
+	if err := c.acceptHandshake(); err != nil {
+		serv.logger.Warn("[RPC] rejecting connection from %v on %s: %v", c.addr, addr, err)
+		c.conn.Close()
+		c.dispatch.close()
+		return
+	}
+
+	if serv.connHandler != nil {
+		err := serv.connHandler(c)
+		if err != nil {
+			serv.logger.Error("[RPC] initializing connection on %s: %v", addr, err)
+			c.conn.Close()
+			c.dispatch.close()
+			return
+		}
+	}
+
+	if !serv.track(c) {
+		c.conn.Close()
+		c.dispatch.close()
+		return
+	}
+	c.serve()
+}
+
+func (serv *Server) isShutdown() bool {
+	serv.mu.Lock()
+	defer serv.mu.Unlock()
+	return serv.shutdown
 }
 
 //
-// Stop listening.  Close will not return until listener
-// goroutine has exited.
+// Add c to the Server's connections, unless the Server is shutting
+// down.
 //
-func (serv *Server) Close() error {
+func (serv *Server) track(c *Conn) bool {
+	serv.mu.Lock()
+	if serv.shutdown {
+		serv.mu.Unlock()
+		return false
+	}
+	serv.conns[c] = struct{}{}
+	serv.mu.Unlock()
+
+	go func() {
+		<-c.Done()
+		serv.mu.Lock()
+		delete(serv.conns, c)
+		serv.mu.Unlock()
+		serv.subs.drop(c)
+	}()
+	return true
+}
+
+func (serv *Server) connections() []*Conn {
+	serv.mu.Lock()
+	defer serv.mu.Unlock()
+
+	conns := make([]*Conn, 0, len(serv.conns))
+	for c := range serv.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+//
+// Stop accepting and wait for the listener goroutine to exit.
+//
+func (serv *Server) stopListening() {
+	serv.mu.Lock()
+	stopped := serv.shutdown
 	serv.shutdown = true
-	serv.listener.Close()
+	ln := serv.listener
+	serv.mu.Unlock()
+
+	if ln == nil {
+		return
+	}
+	if !stopped {
+		ln.Close()
+	}
 	<-serv.shutdownChan
+}
+
+//
+// Stop listening and close every accepted connection immediately.
+// Close will not return until listener goroutine has exited.  See
+// Shutdown for a graceful alternative.
+//
+func (serv *Server) Close() error {
+	serv.stopListening()
+
+	for _, c := range serv.connections() {
+		c.Close()
+	}
 	return nil
 }
 
+//
+// Gracefully shut down: stop accepting, stop dispatching new requests
+// (they are answered with an error), wait for in-flight
+// RequestHandlers to send their Responses, then say goodbye to each
+// peer and close.  If ctx expires first, the remaining connections
+// are closed immediately and ctx.Err() is returned.
+//
+func (serv *Server) Shutdown(ctx context.Context) error {
+	serv.stopListening()
+
+	conns := serv.connections()
+	errs := make(chan error, len(conns))
+	for _, c := range conns {
+		go func(c *Conn) {
+			errs <- c.drain(ctx)
+		}(c)
+	}
+
+	var err error
+	for range conns {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
 //
 // Conn is Symmetric.  Both server and client can register
 // RequestHandlers and EventHandlers, and both can SendEvent() and
@@ -142,7 +377,9 @@ func (serv *Server) Close() error {
 type Conn struct {
 	Alive bool
 	conn io.ReadWriteCloser
-	outstanding map[uint64]*Future
+	outstanding map[uint64]pending
+	inflight map[uint64]context.CancelFunc
+	inbound map[uint64]*msgQueue
 	mu sync.Mutex
 	connmu sync.Mutex
 	logger *log.Logger
@@ -150,34 +387,91 @@ type Conn struct {
 	br *bufio.Reader
 	dec *codec.Decoder
 	enc *codec.Encoder
+	msgw messageWriter
 	addr string
 	reqHandler RequestHandler
 	evtHandler EventHandler
-	shutdownChan chan int
+	services *registry
+	serverServices *registry
+	dispatch *dispatcher
+	opts Options
+	interceptors *interceptors
+	serverInterceptors *interceptors
+	metadata Metadata
+	peer *PeerInfo
+	identity *Identity
+	flow *flowControl
+	closeHandler CloseHandler
+	draining bool
+	idle chan struct{}
+	goaway bool
+	closing bool
+	closeErr error
+	done chan struct{}
+	// closed as soon as the Conn starts closing, before done
+	stopping chan struct{}
+	stopOnce sync.Once
 }
 
-func newConn(transportConn *transportConn, logout io.Writer, handler ConnectionHandler) (*Conn, error) {
+func newConnection(sock io.ReadWriteCloser, addr string, logger *log.Logger, opts *Options) *Conn {
 
-	bw := bufio.NewWriterSize(transportConn.Socket, bufSize)
-	br := bufio.NewReaderSize(transportConn.Socket, bufSize)
+	bw := bufio.NewWriterSize(sock, bufSize)
+	br := bufio.NewReaderSize(sock, bufSize)
+	msgw, _ := sock.(messageWriter)
 
-	c := &Conn{
+	return &Conn{
 		Alive: true,
-		conn: transportConn.Socket,
-		outstanding: make(map[uint64]*Future),
-		logger: log.New(logout),
+		conn: sock,
+		outstanding: make(map[uint64]pending),
+		inflight: make(map[uint64]context.CancelFunc),
+		inbound: make(map[uint64]*msgQueue),
+		logger: logger,
 		bw: bw,
 		br: br,
 		dec: codec.NewDecoder(br, &mph),
 		enc: codec.NewEncoder(bw, &mph),
-		addr: transportConn.Address,
-		shutdownChan: make(chan int),
+		msgw: msgw,
+		addr: addr,
+		services: newRegistry(),
+		interceptors: newInterceptors(nil),
+		dispatch: newDispatcher(opts),
+		opts: *opts,
+		done: make(chan struct{}),
+		stopping: make(chan struct{}),
+	}
+}
+
+//
+// Dial addr over the given Transport and start serving the new Conn.
+// opts may be nil.
+//
+func Dial(transport Transport, addr string, opts *Options) (*Conn, error) {
+	tc, err := transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(tc, opts)
+}
+
+func newConn(transportConn *TransportConn, opts *Options) (*Conn, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	c := newConnection(transportConn.Socket, transportConn.Address, log.New(opts.Logger), opts)
+	c.interceptors = newInterceptors(opts)
+
+	if err := c.handshake(); err != nil {
+		c.conn.Close()
+		c.dispatch.close()
+		return nil, err
 	}
 
-	if handler != nil {
+	if handler := opts.ConnectionHandler; handler != nil {
 		err := handler(c)
 		if err != nil {
-			c.Close()
+			c.conn.Close()
+			c.dispatch.close()
 			return nil, err
 		}
 	}
@@ -192,28 +486,141 @@ func newConn(transportConn *transportConn, logout io.Writer, handler ConnectionH
 // Returns a Future that can be used to await the result.
 //
 func (c *Conn) SendRequest(method string, args ... interface{}) (*Future, error) {
-	if !c.Alive {
-		return nil, fmt.Errorf("request on inactive connection")
+	return c.SendRequestContext(context.Background(), method, args...)
+}
+
+//
+// Send an asynchronous RMI Request bound to ctx.  If ctx is cancelled
+// or its deadline passes before the response arrives, the Future fails
+// with ctx.Err() and the peer is sent a cancel, which is observable by
+// the remote RequestHandler through Request.Context().  The deadline,
+// if any, is propagated to the peer as well.
+//
+func (c *Conn) SendRequestContext(ctx context.Context, method string, args ... interface{}) (*Future, error) {
+	send := c.chainClient(c.sendRequestContext)
+	return send(ctx, method, args)
+}
+
+func (c *Conn) sendRequestContext(ctx context.Context, method string, args []interface{}) (*Future, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var deadline int64
+	if d, ok := ctx.Deadline(); ok {
+		deadline = d.UnixNano()
 	}
 
 	req := &Request{
 		Method: method,
 		Id: genID(),
+		Metadata: c.outgoingMetadata(ctx),
 	}
+	f := newFuture(c, req.Id, method)
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	_, err := encodeRequest(c, req, args)
+	err := c.sendRequest(req, deadline, args, f)
 	if err != nil {
 		return nil, err
 	}
 
+	c.watch(ctx, f.done, f.cancel)
 
-	f := newFuture()
+	return f, nil
+}
 
-	c.outstanding[req.Id] = f
+//
+// A request awaiting its response: a Future or a Stream.
+//
+type pending interface {
+	finish(res *frame, err error)
+	requestMethod() string
+}
 
-	return f, nil
+func (c *Conn) sendRequest(req *Request, deadline int64, args []interface{}, p pending) error {
+	c.mu.Lock()
+	if !c.Alive {
+		c.mu.Unlock()
+		return fmt.Errorf("request on inactive connection: %w", ErrConnectionClosed)
+	}
+	if c.goaway {
+		c.mu.Unlock()
+		return fmt.Errorf("request on connection closing by peer: %w", ErrConnectionClosed)
+	}
+	c.outstanding[req.Id] = p
+	c.mu.Unlock()
+
+	// Not under c.mu: the reader writes too, and takes c.mu to
+	// deliver responses.
+	_, err := encodeRequest(c, req, deadline, args)
+	if err != nil {
+		c.mu.Lock()
+		delete(c.outstanding, req.Id)
+		c.mu.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+//
+// Call cancel with ctx.Err() if ctx is done before done is closed.
+//
+func (c *Conn) watch(ctx context.Context, done <-chan struct{}, cancel func(error)) {
+	if ctx.Done() == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			cancel(ctx.Err())
+		}
+	}()
+}
+
+//
+// Forget an outstanding request and ask the peer to cancel it.
+// Returns false if the request was no longer outstanding.
+//
+func (c *Conn) cancelRequest(id uint64) bool {
+	c.mu.Lock()
+	_, ok := c.outstanding[id]
+	delete(c.outstanding, id)
+	alive := c.Alive
+	c.mu.Unlock()
+
+	if ok && alive {
+		err := encodeCancel(c, id)
+		if err != nil {
+			c.logger.Warn("[RPC] sending cancel to %v: %v", c.addr, err)
+		}
+	}
+
+	return ok
+}
+
+//
+// Release the context of an inbound request once it is answered.
+//
+func (c *Conn) finishRequest(id uint64) {
+	c.mu.Lock()
+	cancel := c.inflight[id]
+	in := c.inbound[id]
+	delete(c.inflight, id)
+	delete(c.inbound, id)
+	if c.idle != nil && len(c.inflight) == 0 {
+		close(c.idle)
+		c.idle = nil
+	}
+	c.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	if in != nil {
+		in.discard()
+	}
+	c.forgetStream(id)
 }
 
 //
@@ -222,11 +629,27 @@ func (c *Conn) SendRequest(method string, args ... interface{}) (*Future, error)
 // no guarantee they arrive if the connection is lost.
 //
 func (c *Conn) SendEvent(method string, data interface{}) error {
-	if !c.Alive {
-		return fmt.Errorf("send event on inactive connection")
+	return c.SendEventContext(context.Background(), method, data)
+}
+
+//
+// Send an asynchronous Event with the metadata attached to ctx.
+//
+func (c *Conn) SendEventContext(ctx context.Context, method string, data interface{}) error {
+	send := c.chainClientEvent(c.sendEvent)
+	return send(ctx, method, data)
+}
+
+func (c *Conn) sendEvent(ctx context.Context, method string, data interface{}) error {
+	if !c.IsAlive() {
+		return fmt.Errorf("send event on inactive connection: %w", ErrConnectionClosed)
 	}
 
-	return encodeEvent(c, method, data)
+	payload := encodeBytes(data)
+	if err := c.acquireCredit(ctx, nil, 0, len(payload)); err != nil {
+		return err
+	}
+	return encodeEvent(c, method, c.outgoingMetadata(ctx), payload)
 }
 
 //
@@ -243,31 +666,210 @@ func (c *Conn) OnEvent(handler EventHandler) {
 	c.evtHandler = handler
 }
 
+//
+// Register a handler to be called once the connection is lost or
+// closed.  err wraps ErrConnectionClosed, and the cause of the loss
+// if it was not closed locally.
+//
+func (c *Conn) OnClose(handler CloseHandler) {
+	c.closeHandler = handler
+}
+
+//
+// Done returns a channel that is closed once the connection is
+// lost or closed, and every pending Future has been failed.
+//
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+//
+// The reason the connection was lost, or nil if it is still alive.
+//
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeErr
+}
+
+//
+// Whether the connection is still usable for new requests.  False
+// once the connection is lost, or the peer has announced it is
+// shutting down.
+//
+func (c *Conn) IsAlive() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Alive && !c.goaway
+}
+
+//
+// The TLS connection state, completing the handshake first if
+// necessary.  ok is false if the connection is not over TLS or the
+// handshake failed.
+//
+func (c *Conn) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+	tc, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return state, false
+	}
+	if err := tc.Handshake(); err != nil {
+		return state, false
+	}
+	return tc.ConnectionState(), true
+}
+
+//
+// The certificates presented by the peer, leaf first.  Nil if the
+// connection is not over TLS or the peer sent none.
+//
+func (c *Conn) PeerCertificates() []*x509.Certificate {
+	state, ok := c.TLSConnectionState()
+	if !ok {
+		return nil
+	}
+	return state.PeerCertificates
+}
+
+//
+// The peer certificate chains verified against the configured roots.
+// Populated on a server when client certificates are verified, and on
+// a client unless InsecureSkipVerify is set.
+//
+func (c *Conn) VerifiedChains() [][]*x509.Certificate {
+	state, ok := c.TLSConnectionState()
+	if !ok {
+		return nil
+	}
+	return state.VerifiedChains
+}
+
 //
 // Close the connection.  Close will not return until the
 // goroutine reading events and requests exits.
 //
 func (c *Conn) Close() error {
-	if !c.Alive {
+	c.mu.Lock()
+	alive := c.Alive
+	c.closing = true
+	c.mu.Unlock()
+
+	if !alive {
 		return fmt.Errorf("shutdown on inactive connection")
 	}
 
-	c.Alive = false
+	c.stop()
 	c.conn.Close()
-	<-c.shutdownChan
+	<-c.done
 	return nil
 }
 
+//
+// Wake senders waiting for flow control credit, which would otherwise
+// keep handlers, and so Close, from finishing.
+//
+func (c *Conn) stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopping)
+	})
+}
+
+//
+// Refuse new requests, wait for inflight ones to be answered, then
+// send a goodbye and close.  If ctx expires first, close anyway.
+//
+func (c *Conn) drain(ctx context.Context) error {
+	c.mu.Lock()
+	c.draining = true
+	idle := c.idle
+	if idle == nil && len(c.inflight) > 0 {
+		idle = make(chan struct{})
+		c.idle = idle
+	}
+	c.mu.Unlock()
+
+	var err error
+	if idle != nil {
+		select {
+		case <-idle:
+		case <-c.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	if err == nil && c.IsAlive() {
+		if e := encodeGoodbye(c); e != nil {
+			c.logger.Warn("[RPC] sending goodbye to %v: %v", c.addr, e)
+		}
+	}
+
+	c.Close()
+	return err
+}
+
+//
+// Tear down after the reader exits: fail every pending Future,
+// cancel every inbound request and notify the close handler.
+//
+func (c *Conn) shutdown(cause error) {
+	c.mu.Lock()
+	err := ErrConnectionClosed
+	if !c.closing {
+		err = fmt.Errorf("%w: %v", ErrConnectionClosed, cause)
+	}
+	c.Alive = false
+	c.closeErr = err
+	outstanding := c.outstanding
+	inflight := c.inflight
+	c.outstanding = make(map[uint64]pending)
+	c.inflight = make(map[uint64]context.CancelFunc)
+	c.inbound = make(map[uint64]*msgQueue)
+	c.mu.Unlock()
+
+	c.stop()
+	c.conn.Close()
+	c.dispatch.close()
+
+	for _, p := range outstanding {
+		p.finish(nil, err)
+	}
+	for _, cancel := range inflight {
+		cancel()
+	}
+
+	close(c.done)
+
+	if c.closeHandler != nil {
+		c.closeHandler(c, err)
+	}
+}
+
 func (c *Conn) handleResponse(frm *frame) {
 	c.mu.Lock()
-	f := c.outstanding[frm.Id]
+	p := c.outstanding[frm.Id]
 	delete(c.outstanding, frm.Id)
 	c.mu.Unlock()
 
-	if frm.Error != "" {
-		f.error(errors.New(frm.Error))
+	if p == nil {
+		c.logger.Trace("[RPC] Dropping response to abandoned request %v", frm.Id)
+		return
+	}
+
+	if frm.Error != "" || frm.Code != 0 {
+		code := Code(frm.Code)
+		if code == 0 {
+			code = CodeUnknown
+		}
+		p.finish(frm, &RemoteError{
+			Code: code,
+			Message: frm.Error,
+			Details: frm.Details,
+			Method: p.requestMethod(),
+			Stack: frm.Stack,
+		})
 	} else {
-		f.complete(frm)
+		p.finish(frm, nil)
 	}
 }
 
@@ -275,34 +877,187 @@ func (c *Conn) handleEvent(frm *frame) {
 	evt := &Event{
 		Event: frm.Method,
 		Payload: frm.Payload,
+		Metadata: frm.Meta,
 	}
 
+	if p := c.opts.Policy; p != nil && !p.AllowEvent(c.identity, evt.Event) {
+		c.logger.Warn("[RPC] Denied event %q from %s at %v", evt.Event, identityName(c.identity), c.addr)
+		c.consumed(0, len(frm.Payload))
+		return
+	}
+
+	handler := c.chainEvent(c.routeEvent)
+
+	c.dispatch.event(func() {
+		defer c.consumed(0, len(frm.Payload))
+		defer c.recoverEvent(evt)
+		handler(evt)
+	})
+}
+
+//
+// The innermost EventHandler, behind any interceptors.
+//
+func (c *Conn) routeEvent(evt *Event) {
+	if c.evtHandler == nil {
+		c.logger.Warn("[RPC] No EventHandler for %v from %v, dropping it", evt.Event, c.addr)
+		return
+	}
 	c.evtHandler(evt)
 }
 
+func (c *Conn) handleCancel(frm *frame) {
+	c.finishRequest(frm.Id)
+}
+
+func (c *Conn) handleGoodbye(frm *frame) {
+	c.mu.Lock()
+	c.goaway = true
+	c.mu.Unlock()
+}
+
 func (c *Conn) handleRequest(frm *frame) {
 
+	response := &Response{
+		Id: frm.Id,
+		conn: c,
+	}
+
+	if p := c.opts.Policy; p != nil && !p.AllowRequest(c.identity, frm.Method) {
+		c.logger.Warn("[RPC] Denied request %q from %s at %v", frm.Method, identityName(c.identity), c.addr)
+		response.SendError(Errorf(CodePermissionDenied, "permission denied for %q", frm.Method))
+		return
+	}
+
+	c.mu.Lock()
+	if c.draining {
+		c.mu.Unlock()
+		response.SendError(Errorf(CodeUnavailable, "connection shutting down"))
+		return
+	}
+
+	ctx := context.Background()
+	if c.identity != nil {
+		ctx = context.WithValue(ctx, identityKey{}, c.identity)
+	}
+	if len(frm.Meta) > 0 {
+		ctx = context.WithValue(ctx, incomingKey{}, Metadata(frm.Meta))
+	}
+
+	var cancel context.CancelFunc
+	if frm.Deadline != 0 {
+		ctx, cancel = context.WithDeadline(ctx, time.Unix(0, frm.Deadline))
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	c.inflight[frm.Id] = cancel
+	_, stream := c.lookupService(frm.Method).(StreamHandler)
+	if stream {
+		response.in = newMsgQueue(func(credit int) {
+			if ctx.Err() != nil {
+				c.consumed(0, credit)
+			} else {
+				c.consumed(frm.Id, credit)
+			}
+		})
+		c.inbound[frm.Id] = response.in
+	}
+	c.mu.Unlock()
+	response.ctx = ctx
+
 	req := &Request{
 		Method: frm.Method,
 		Id: frm.Id,
 		Payload: frm.Payload,
+		Metadata: frm.Meta,
+		ctx: ctx,
 	}
 
-	response := &Response{
-		Id: frm.Id,
-		conn: c,
+	handler := c.chainRequest(c.route)
+	dispatch := c.dispatch.request
+	if stream {
+		dispatch = c.dispatch.stream
+	}
+
+	ok := dispatch(func() {
+		defer c.recoverRequest(req, response)
+		handler(req, response)
+		if !response.settled() {
+			c.logger.Warn("[RPC] Handler for %v from %v returned without responding", req.Method, c.addr)
+			response.SendError(Errorf(CodeInternal, "handler for %q returned without responding", req.Method))
+		}
+	})
+	if !ok {
+		c.logger.Warn("[RPC] Refusing request %v from %v: queue full", frm.Method, c.addr)
+		response.SendError(Errorf(CodeResourceExhausted, "request queue full"))
+	}
+}
+
+//
+// The innermost RequestHandler, behind any interceptors: registered
+// methods and StreamHandlers first, then the RequestHandler.
+//
+func (c *Conn) route(req *Request, response *Response) {
+	switch fn := c.lookupService(req.Method).(type) {
+	case StreamHandler:
+		c.serveStream(fn, req, response)
+	case RequestHandler:
+		fn(req, response)
+	case nil:
+		if c.reqHandler != nil {
+			c.reqHandler(req, response)
+		} else {
+			response.SendError(Errorf(CodeUnimplemented, "unknown method %q", req.Method))
+		}
+	default:
+		serveFunc(fn, req, response)
+	}
+}
+
+func (c *Conn) recoverRequest(req *Request, response *Response) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	stack := c.reportPanic(req.Method, p)
+
+	re := Errorf(CodeInternal, "panic in handler for %q: %v", req.Method, p)
+	if c.opts.SendPanicStack {
+		re.Stack = string(stack)
 	}
+	response.SendError(re)
+}
 
-	c.reqHandler(req, response)
+func (c *Conn) recoverEvent(evt *Event) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	c.reportPanic(evt.Event, p)
+}
+
+func (c *Conn) reportPanic(method string, p interface{}) []byte {
+	stack := debug.Stack()
+	c.logger.Error("[RPC] panic in handler for %v from %v: %v\n%s", method, c.addr, p, stack)
+	if c.opts.PanicHandler != nil {
+		c.opts.PanicHandler(c, method, p, stack)
+	}
+	return stack
 }
 
 func (c *Conn) serve() {
-	c.Alive = true
 	for {
 		frm, err := readFrame(c)
 		if err != nil {
-			c.Alive = false
-			c.logger.Error("[RPC] error reading RPC frame: %v", err)
+			c.mu.Lock()
+			closing := c.closing
+			c.mu.Unlock()
+			if err == io.EOF {
+				c.logger.Info("[RPC] Connection closed by %v", c.addr)
+			} else if !closing {
+				c.logger.Error("[RPC] error reading RPC frame: %v", err)
+			}
+			c.shutdown(err)
 			return
 		}
 		switch frm.Type {
@@ -321,7 +1076,26 @@ func (c *Conn) serve() {
 				c.addr, frm.Method)
 
 			c.handleEvent(frm)
+		case STREAM:
+			c.logger.Trace("[RPC] Stream message from %v. %v",
+				c.addr, frm.Id)
+
+			c.handleStream(frm)
+		case SEND:
+			c.handleSend(frm)
+		case HALFCLOSE:
+			c.handleHalfClose(frm)
+		case WINDOW:
+			c.handleWindow(frm)
+		case CANCEL:
+			c.logger.Trace("[RPC] Cancel from %v. %v",
+				c.addr, frm.Id)
+
+			c.handleCancel(frm)
+		case GOODBYE:
+			c.logger.Info("[RPC] Goodbye from %v", c.addr)
+
+			c.handleGoodbye(frm)
 		}
 	}
-	c.shutdownChan <- 1
 }
\ No newline at end of file
@@ -1,13 +1,26 @@
 package armie
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sort"
+	"path/filepath"
 	"math/rand"
 	"os"
 	"fmt"
 	"testing"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 	"github.com/fred-lewis/armie/log"
+	"github.com/gorilla/websocket"
+	"github.com/ugorji/go/codec"
 )
 
 var test_logger *log.Logger
@@ -16,6 +29,7 @@ var test_conn *Conn
 var test_addr string
 var msg_res_event string
 var msg_res_person person
+var cancel_observed = make(chan error, 1)
 
 func TestMain(m *testing.M) {
 	err := setup()
@@ -95,6 +109,1982 @@ func TestEvents(t *testing.T) {
 	}
 }
 
+func TestRequestDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+
+	f, err := test_conn.SendRequestContext(ctx, "CANCELTEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res int
+	err = f.GetResultContext(context.Background(), &res)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded, got: %v", err)
+	}
+
+	test_conn.mu.Lock()
+	_, ok := test_conn.outstanding[f.id]
+	test_conn.mu.Unlock()
+	if ok {
+		t.Error("Outstanding entry not removed")
+	}
+
+	select {
+	case err := <-cancel_observed:
+		if err != context.Canceled && err != context.DeadlineExceeded {
+			t.Errorf("Unexpected remote context error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Remote handler never observed cancellation")
+	}
+}
+
+func TestGetResultContextCancel(t *testing.T) {
+	f, err := test_conn.SendRequest("CANCELTEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = f.GetResultContext(ctx, nil)
+	if err != context.Canceled {
+		t.Fatalf("Expected canceled, got: %v", err)
+	}
+	select {
+	case <-cancel_observed:
+	case <-time.After(time.Second):
+		t.Error("Remote handler never observed cancellation")
+	}
+}
+
+func TestConnectionLossFailsFutures(t *testing.T) {
+	for _, local := range []bool{true, false} {
+		conn, err := NewTCPConnection(test_addr, os.Stdout, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		closed := make(chan error, 1)
+		conn.OnClose(func(c *Conn, err error) {
+			closed <- err
+		})
+
+		f, err := conn.SendRequest("HANGTEST")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if local {
+			conn.Close()
+		} else {
+			// simulate the peer hanging up
+			conn.conn.Close()
+		}
+
+		err = f.GetResult(nil)
+		if !errors.Is(err, ErrConnectionClosed) {
+			t.Errorf("Expected ErrConnectionClosed, got: %v", err)
+		}
+
+		select {
+		case <-conn.Done():
+		case <-time.After(time.Second):
+			t.Fatal("Done channel not closed")
+		}
+
+		if err := <-closed; !errors.Is(err, ErrConnectionClosed) {
+			t.Errorf("Expected ErrConnectionClosed in OnClose, got: %v", err)
+		}
+
+		_, err = conn.SendRequest("HANGTEST")
+		if !errors.Is(err, ErrConnectionClosed) {
+			t.Errorf("Expected ErrConnectionClosed on dead conn, got: %v", err)
+		}
+	}
+}
+
+func TestReconnectingConn(t *testing.T) {
+	states := make(chan ConnState, 16)
+	rc := NewReconnectingTCPConnection(test_addr, os.Stdout, nil, ReconnectOptions{
+		InitialBackoff: 10 * time.Millisecond,
+		Policy: QueueDuringOutage,
+	})
+	defer rc.Close()
+	rc.OnStateChange(func(state ConnState, err error) {
+		states <- state
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2 * time.Second)
+	defer cancel()
+
+	seen := make(map[ConnState]bool)
+	for i := 0; i < 2; i++ {
+		f, err := rc.SendRequestContext(ctx, "INTTEST", 3, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res int
+		if err := f.GetResultContext(ctx, &res); err != nil || res != 12 {
+			t.Fatalf("Got %d, %v", res, err)
+		}
+
+		// simulate a network blip
+		rc.Conn().conn.Close()
+		for s := range states {
+			seen[s] = true
+			if s == StateDisconnected {
+				break
+			}
+		}
+	}
+
+	rc.Close()
+	if rc.State() != StateClosed {
+		t.Errorf("Expected closed, got %v", rc.State())
+	}
+
+	for len(states) > 0 {
+		seen[<-states] = true
+	}
+	for _, s := range []ConnState{StateDisconnected, StateConnecting, StateConnected, StateClosed} {
+		if !seen[s] {
+			t.Errorf("Never saw state %v", s)
+		}
+	}
+}
+
+func TestReconnectingConnFailDuringOutage(t *testing.T) {
+	rc := NewReconnectingTCPConnection("localhost:1", os.Stdout, nil, ReconnectOptions{
+		Policy: FailDuringOutage,
+	})
+	defer rc.Close()
+
+	_, err := rc.SendRequest("INTTEST", 1, 2)
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("Expected ErrConnectionClosed, got: %v", err)
+	}
+}
+
+func TestUnixTransport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "armie.sock")
+	testLocalTransport(t, NewUnixServer(os.Stdout), path, func() (*Conn, error) {
+		return NewUnixConnection(path, os.Stdout, nil)
+	})
+}
+
+func TestPipeTransport(t *testing.T) {
+	testLocalTransport(t, NewPipeServer(os.Stdout), "armie-test", func() (*Conn, error) {
+		return NewPipeConnection("armie-test", os.Stdout, nil)
+	})
+
+	_, err := NewPipeConnection("armie-test", os.Stdout, nil)
+	if err == nil {
+		t.Error("Dialed a closed pipe listener")
+	}
+
+	// without flow control, inline handlers answer from the reader
+	s := NewServer(PipeTransport(), &Options{Logger: os.Stdout, ConnWindow: -1})
+	testLocalTransport(t, s, "armie-test-inline", func() (*Conn, error) {
+		return NewPipeConnection("armie-test-inline", os.Stdout, nil)
+	})
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	s := NewWebSocketServer(os.Stdout)
+	testLocalTransport(t, s, "ws://localhost:0/rpc", func() (*Conn, error) {
+		return NewWebSocketConnection("ws://" + s.listener.Addr().String() + "/rpc", os.Stdout, nil)
+	})
+}
+
+func TestWebSocketListenerOnMux(t *testing.T) {
+	ln := NewWebSocketListener()
+	mux := http.NewServeMux()
+	mux.Handle("/rpc", ln)
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+
+	s := NewServer(WebSocketTransport(nil), &Options{
+		Logger: os.Stdout,
+		ConnectionHandler: func(conn *Conn) error {
+			conn.OnRequest(func(req *Request, res *Response) {
+				if req.Method != "ECHOTEST" {
+					handleRequest(req, res)
+					return
+				}
+				echo, _ := req.CallMethod(func(s string) string { return s })
+				res.Send(echo)
+			})
+			return nil
+		},
+	})
+	s.ListenOn(ln)
+	defer s.Close()
+
+	url := "ws" + strings.TrimPrefix(hs.URL, "http") + "/rpc"
+	conn, err := NewWebSocketConnection(url, os.Stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// larger than the write buffer, but still sent as one message
+	big := strings.Repeat("x", 3 * bufSize)
+	f, err := conn.SendRequest("STRINGTEST", big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res int
+	if err := f.GetResult(&res); err != nil || res != len(big) {
+		t.Errorf("Got %d, %v", res, err)
+	}
+
+	// a raw WebSocket peer sees exactly one frame per message
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	readMessage := func() *frame {
+		mt, msg, err := ws.ReadMessage()
+		if err != nil || mt != websocket.BinaryMessage {
+			t.Fatalf("Got message type %d, %v", mt, err)
+		}
+		var frm frame
+		rd := bytes.NewReader(msg)
+		if err := codec.NewDecoder(rd, &mph).Decode(&frm); err != nil || rd.Len() != 0 {
+			t.Fatalf("Message is not one frame: %v, %d bytes left", err, rd.Len())
+		}
+		return &frm
+	}
+	hello := encodeBytes(&frame{Type: HELLO, Payload: encodeBytes(localPeerInfo(&Options{}))})
+	ws.WriteMessage(websocket.BinaryMessage, hello)
+	if frm := readMessage(); frm.Type != HELLO {
+		t.Fatalf("Expected hello, got frame type %d", frm.Type)
+	}
+	req := encodeBytes(&frame{Type: REQUEST, Method: "ECHOTEST", Id: 1, Payload: encodeBytes(big)})
+	ws.WriteMessage(websocket.BinaryMessage, req)
+	frm := readMessage()
+	var echo string
+	if err := decodeResponse(frm, &echo); frm.Type != RESPONSE || err != nil || echo != big {
+		t.Errorf("Unexpected response frame %d, %v", frm.Type, err)
+	}
+}
+
+func newPipeTestServer(t *testing.T, name string) *Server {
+	s := NewPipeServer(os.Stdout)
+	s.OnConnection(func(conn *Conn) error {
+		conn.OnRequest(handleRequest)
+		return nil
+	})
+	if err := s.Listen(name); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	s := newPipeTestServer(t, "armie-shutdown")
+	conn, err := NewPipeConnection("armie-shutdown", os.Stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slow, err := conn.SendRequest("SLOWTEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2 * time.Second)
+		defer cancel()
+		shutdown <- s.Shutdown(ctx)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// new requests are refused while draining
+	f, err := conn.SendRequest("INTTEST", 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.GetResult(nil); err == nil {
+		t.Error("Request accepted while draining")
+	}
+
+	var res int
+	if err := slow.GetResult(&res); err != nil || res != 1 {
+		t.Errorf("In-flight request not completed: %d, %v", res, err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+
+	select {
+	case <-conn.Done():
+	case <-time.After(time.Second):
+		t.Error("Client connection not closed")
+	}
+	if _, err := NewPipeConnection("armie-shutdown", os.Stdout, nil); err == nil {
+		t.Error("Server still accepting")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	s := newPipeTestServer(t, "armie-shutdown-deadline")
+	conn, err := NewPipeConnection("armie-shutdown-deadline", os.Stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := conn.SendRequest("HANGTEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	if err := f.GetResult(nil); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("Expected ErrConnectionClosed, got %v", err)
+	}
+}
+
+func newDispatchTestPair(t *testing.T, name string, opts *Options) (*Server, *Conn) {
+	opts.Logger = os.Stdout
+	opts.ConnectionHandler = func(conn *Conn) error {
+		conn.OnRequest(func(req *Request, res *Response) {
+			switch req.Method {
+			case "SLEEP":
+				time.Sleep(100 * time.Millisecond)
+				res.Send(nil)
+			case "NESTED":
+				// call back into the peer from inside a handler
+				f, err := conn.SendRequest("INTTEST", 2, 3)
+				if err != nil {
+					res.Error(err.Error())
+					return
+				}
+				var n int
+				if err := f.GetResult(&n); err != nil {
+					res.Error(err.Error())
+					return
+				}
+				res.Send(n + 1)
+			}
+		})
+		conn.OnEvent(func(evt *Event) {})
+		return nil
+	}
+	s := NewServer(PipeTransport(), opts)
+	if err := s.Listen(name); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := NewPipeConnection(name, os.Stdout, func(conn *Conn) error {
+		conn.OnRequest(handleRequest)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, conn
+}
+
+func TestDispatchGoroutine(t *testing.T) {
+	s, conn := newDispatchTestPair(t, "armie-dispatch-goroutine", &Options{Dispatch: DispatchGoroutine})
+	defer s.Close()
+
+	start := time.Now()
+	futures := make([]*Future, 5)
+	for i := range futures {
+		futures[i], _ = conn.SendRequest("SLEEP")
+	}
+	for _, f := range futures {
+		if err := f.GetResult(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 300 * time.Millisecond {
+		t.Errorf("Requests were not dispatched concurrently: %v", elapsed)
+	}
+
+	f, err := conn.SendRequest("NESTED")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var res int
+	if err := f.GetResultContext(ctx, &res); err != nil || res != 7 {
+		t.Errorf("Nested request got %d, %v", res, err)
+	}
+}
+
+func TestDispatchPoolQueueFull(t *testing.T) {
+	s, conn := newDispatchTestPair(t, "armie-dispatch-pool", &Options{
+		Dispatch: DispatchPool,
+		Workers: 1,
+		QueueDepth: 1,
+	})
+	defer s.Close()
+
+	futures := make([]*Future, 4)
+	for i := range futures {
+		futures[i], _ = conn.SendRequest("SLEEP")
+	}
+	refused := 0
+	for _, f := range futures {
+		if f.GetResult(nil) != nil {
+			refused++
+		}
+	}
+	if refused == 0 {
+		t.Error("Expected requests beyond the queue depth to be refused")
+	}
+}
+
+func TestDispatchPoolEventsDuringNestedRequest(t *testing.T) {
+	s, _ := newDispatchTestPair(t, "armie-dispatch-pool-events", &Options{
+		Dispatch: DispatchPool,
+		Workers: 1,
+		QueueDepth: 1,
+	})
+	defer s.Close()
+	// a client slow to answer the nested request, so the events below
+	// arrive while the only request worker waits for it
+	conn, err := NewPipeConnection("armie-dispatch-pool-events", os.Stdout, func(conn *Conn) error {
+		conn.OnRequest(func(req *Request, res *Response) {
+			time.Sleep(50 * time.Millisecond)
+			handleRequest(req, res)
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	f, err := conn.SendRequest("NESTED")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn.SendRequest("SLEEP")
+		for i := 0; i < 5; i++ {
+			conn.SendEvent("IGNORED", i)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var res int
+	if err := f.GetResultContext(ctx, &res); err != nil || res != 7 {
+		t.Errorf("Nested request got %d, %v", res, err)
+	}
+}
+
+func TestDispatchOrderedEvents(t *testing.T) {
+	var mu sync.Mutex
+	var got []int
+	opts := &Options{
+		Dispatch: DispatchGoroutine,
+		OrderedEvents: true,
+		ConnectionHandler: func(conn *Conn) error {
+			conn.OnEvent(func(evt *Event) {
+				var n int
+				evt.Decode(&n)
+				mu.Lock()
+				got = append(got, n)
+				mu.Unlock()
+			})
+			return nil
+		},
+		Logger: os.Stdout,
+	}
+	s := NewServer(PipeTransport(), opts)
+	if err := s.Listen("armie-dispatch-events"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn, err := NewPipeConnection("armie-dispatch-events", os.Stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		conn.SendEvent("SEQ", i)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 100 {
+		t.Fatalf("Got %d events", len(got))
+	}
+	for i, n := range got {
+		if n != i {
+			t.Fatalf("Event %d out of order: %d", i, n)
+		}
+	}
+}
+
+type calculator struct {
+	scale int
+}
+
+func (c *calculator) Add(a, b int) int {
+	return c.scale * (a + b)
+}
+
+func (c *calculator) Div(a, b int) (int, error) {
+	if b == 0 {
+		return 0, errors.New("division by zero")
+	}
+	return a / b, nil
+}
+
+func (c *calculator) unexported() {}
+
+func TestRegisterService(t *testing.T) {
+	s := NewPipeServer(os.Stdout)
+	if err := s.Register("Calc", &calculator{scale: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterFunc("objtest", objTest); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterFunc("bad", 5); err == nil {
+		t.Error("Registered a non-func")
+	}
+	if err := s.Listen("armie-services"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := NewPipeConnection("armie-services", os.Stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res int
+	f, _ := conn.SendRequest("Calc.Add", 2, 3)
+	if err := f.GetResult(&res); err != nil || res != 10 {
+		t.Errorf("Calc.Add got %d, %v", res, err)
+	}
+	f, _ = conn.SendRequest("Calc.Div", 9, 3)
+	if err := f.GetResult(&res); err != nil || res != 3 {
+		t.Errorf("Calc.Div got %d, %v", res, err)
+	}
+	f, _ = conn.SendRequest("Calc.Div", 9, 0)
+	if err := f.GetResult(&res); err == nil || err.Error() != "division by zero" {
+		t.Errorf("Expected division by zero, got %v", err)
+	}
+
+	var str string
+	f, _ = conn.SendRequest("objtest", &person{Name: "eve", Age: 50})
+	if err := f.GetResult(&str); err != nil || str != "eve is 50" {
+		t.Errorf("objtest got %q, %v", str, err)
+	}
+
+	for _, method := range []string{"Calc.unexported", "Calc.Mul"} {
+		f, _ = conn.SendRequest(method)
+		if err := f.GetResult(nil); err == nil || !strings.Contains(err.Error(), "unknown method") {
+			t.Errorf("Expected unknown method for %s, got %v", method, err)
+		}
+	}
+}
+
+func TestTypedCall(t *testing.T) {
+	n, err := Call[int](test_conn, "INTTEST", 4, 5)
+	if err != nil || n != 20 {
+		t.Errorf("Got %d, %v", n, err)
+	}
+
+	p, err := Call[person](test_conn, "OBJRETTEST")
+	if err != nil || p.Name != "bill" || p.Age != 45 {
+		t.Errorf("Got %v, %v", p, err)
+	}
+
+	tf, err := Send[string](test_conn, "OBJTEST", &person{Name: "sue", Age: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	str, err := tf.Get()
+	if err != nil || str != "sue is 9" {
+		t.Errorf("Got %q, %v", str, err)
+	}
+
+	_, err = Call[[]int](test_conn, "OBJTEST", &person{Name: "sue", Age: 9})
+	if err == nil {
+		t.Error("Expected a decode error")
+	}
+}
+
+func TestTypedEventHandler(t *testing.T) {
+	got := make(chan person, 1)
+	failed := make(chan error, 1)
+	handler := TypedEventHandler(func(evt *Event, p person) {
+		got <- p
+	}, func(evt *Event, err error) {
+		failed <- err
+	})
+
+	event := func(v interface{}) *Event {
+		var buf bytes.Buffer
+		codec.NewEncoder(&buf, &mph).Encode(v)
+		return &Event{Event: "PERSON", Payload: buf.Bytes()}
+	}
+
+	handler(event(person{Name: "tim", Age: 3}))
+	if p := <-got; p.Name != "tim" || p.Age != 3 {
+		t.Errorf("Got %v", p)
+	}
+
+	handler(event("not a person"))
+	select {
+	case <-failed:
+	case <-got:
+		t.Error("Mismatched payload was delivered")
+	}
+}
+
+type missingError struct {
+	name string
+}
+
+func (e *missingError) Error() string {
+	return e.name + " not found"
+}
+
+func (e *missingError) ErrorCode() Code {
+	return CodeNotFound
+}
+
+func (e *missingError) ErrorDetails() interface{} {
+	return map[string]string{"name": e.name}
+}
+
+func TestRemoteErrors(t *testing.T) {
+	s := NewPipeServer(os.Stdout)
+	s.RegisterFunc("Find", func(name string) (int, error) {
+		return 0, &missingError{name}
+	})
+	s.RegisterFunc("Deny", func() error {
+		return Errorf(CodePermissionDenied, "no access").WithDetails("admin only")
+	})
+	s.RegisterFunc("Plain", func() error {
+		return errors.New("plain failure")
+	})
+	s.RegisterFunc("Code", func() (string, error) {
+		return "", CodeNotFound
+	})
+	errGone := Errorf(CodeNotFound, "gone")
+	for _, name := range []string{"GoneA", "GoneB"} {
+		s.RegisterFunc(name, func() error {
+			return errGone
+		})
+	}
+	if err := s.Listen("armie-errors"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn, err := NewPipeConnection("armie-errors", os.Stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Call[int](conn, "Find", "widget")
+	var re *RemoteError
+	if !errors.As(err, &re) {
+		t.Fatalf("Expected a RemoteError, got %T: %v", err, err)
+	}
+	if !errors.Is(err, CodeNotFound) || re.Method != "Find" || re.Message != "widget not found" {
+		t.Errorf("Unexpected error: %+v", re)
+	}
+	var details map[string]string
+	if err := re.DecodeDetails(&details); err != nil || details["name"] != "widget" {
+		t.Errorf("Got details %v, %v", details, err)
+	}
+
+	_, err = Call[interface{}](conn, "Deny")
+	var why string
+	if !errors.Is(err, CodePermissionDenied) || !errors.As(err, &re) || re.DecodeDetails(&why) != nil || why != "admin only" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if !errors.Is(err, Errorf(CodePermissionDenied, "no access")) || errors.Is(err, Errorf(CodePermissionDenied, "other")) {
+		t.Error("RemoteError matched incorrectly")
+	}
+
+	_, err = Call[interface{}](conn, "Plain")
+	if ErrorCode(err) != CodeUnknown || err.Error() != "plain failure" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	_, err = Call[string](conn, "Code")
+	if !errors.Is(err, CodeNotFound) || ErrorCode(err) != CodeNotFound {
+		t.Errorf("Expected not found, got %v", err)
+	}
+
+	// a shared error is sent with the method of each call
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		method := []string{"GoneA", "GoneB"}[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := Call[interface{}](conn, method)
+			var re *RemoteError
+			if !errors.As(err, &re) || re.Method != method {
+				t.Errorf("Expected an error from %s, got %+v", method, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if errGone.Method != "" {
+		t.Errorf("Handler's error was changed: %+v", errGone)
+	}
+
+	_, err = Call[interface{}](conn, "Nope")
+	if !errors.Is(err, CodeUnimplemented) {
+		t.Errorf("Expected unimplemented, got %v", err)
+	}
+}
+
+func TestMissingHandlers(t *testing.T) {
+	s := NewPipeServer(os.Stdout)
+	if err := s.Listen("armie-missing"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn, err := NewPipeConnection("armie-missing", os.Stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no EventHandler: dropped without killing the connection
+	if err := conn.SendEvent("IGNORED", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// no RequestHandler: method not found
+	_, err = Call[int](conn, "INTTEST", 1, 2)
+	if !errors.Is(err, CodeUnimplemented) {
+		t.Errorf("Expected unimplemented, got %v", err)
+	}
+
+	// a handler that never responds
+	s.OnConnection(func(c *Conn) error {
+		c.OnRequest(func(req *Request, res *Response) {})
+		return nil
+	})
+	conn2, err := NewPipeConnection("armie-missing", os.Stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = CallContext[int](ctx, conn2, "ANYTHING")
+	if !errors.Is(err, CodeInternal) {
+		t.Errorf("Expected internal error, got %v", err)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	panics := make(chan string, 2)
+	s := NewServer(PipeTransport(), &Options{
+		Logger: os.Stdout,
+		SendPanicStack: true,
+		PanicHandler: func(conn *Conn, method string, p interface{}, stack []byte) {
+			panics <- method
+		},
+		ConnectionHandler: func(conn *Conn) error {
+			conn.OnRequest(func(req *Request, res *Response) {
+				panic("request boom")
+			})
+			conn.OnEvent(func(evt *Event) {
+				panic("event boom")
+			})
+			return nil
+		},
+	})
+	if err := s.Listen("armie-panics"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn, err := NewPipeConnection("armie-panics", os.Stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SendEvent("EXPLODE", nil)
+	_, err = Call[int](conn, "EXPLODE")
+	var re *RemoteError
+	if !errors.As(err, &re) || re.Code != CodeInternal || !strings.Contains(re.Message, "request boom") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(re.Stack, "TestPanicRecovery") {
+		t.Errorf("Stack missing from RemoteError: %q", re.Stack)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case method := <-panics:
+			if method != "EXPLODE" {
+				t.Errorf("PanicHandler got method %q", method)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("PanicHandler not called")
+		}
+	}
+	if !conn.IsAlive() {
+		t.Error("Connection died after handler panics")
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	var mu sync.Mutex
+	var trace []string
+	record := func(s string) {
+		mu.Lock()
+		trace = append(trace, s)
+		mu.Unlock()
+	}
+	tracer := func(name string) RequestInterceptor {
+		return func(req *Request, res *Response, next RequestHandler) {
+			record(name)
+			next(req, res)
+		}
+	}
+
+	s := NewServer(PipeTransport(), &Options{
+		Logger: os.Stdout,
+		RequestInterceptors: []RequestInterceptor{tracer("s1")},
+		ConnectionHandler: func(conn *Conn) error {
+			conn.UseRequest(tracer("c1"), func(req *Request, res *Response, next RequestHandler) {
+				if req.Method == "FORBIDDEN" {
+					res.SendError(Errorf(CodePermissionDenied, "no"))
+					return
+				}
+				next(req, res)
+			})
+			conn.OnRequest(handleRequest)
+			conn.OnEvent(func(evt *Event) {
+				record("event " + evt.Event)
+			})
+			return nil
+		},
+	})
+	s.UseRequest(tracer("s2"))
+	s.UseEvent(func(evt *Event, next EventHandler) {
+		if evt.Event != "DROPPED" {
+			next(evt)
+		}
+	})
+	if err := s.Listen("armie-interceptors"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn, err := NewPipeConnection("armie-interceptors", os.Stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sent []string
+	conn.UseClient(func(ctx context.Context, method string, args []interface{}, next SendRequestFunc) (*Future, error) {
+		sent = append(sent, method)
+		return next(ctx, method, args)
+	})
+	conn.UseClientEvent(func(ctx context.Context, event string, data interface{}, next SendEventFunc) error {
+		if event == "BLOCKED" {
+			return errors.New("blocked")
+		}
+		return next(ctx, event, data)
+	})
+
+	if n, err := Call[int](conn, "INTTEST", 2, 3); err != nil || n != 6 {
+		t.Fatalf("Expected 6, got %v, %v", n, err)
+	}
+	mu.Lock()
+	got := strings.Join(trace, " ")
+	mu.Unlock()
+	if got != "s1 s2 c1" {
+		t.Errorf("Unexpected interceptor order %q", got)
+	}
+
+	_, err = Call[int](conn, "FORBIDDEN")
+	if !errors.Is(err, CodePermissionDenied) {
+		t.Errorf("Expected permission denied, got %v", err)
+	}
+	if len(sent) != 2 || sent[1] != "FORBIDDEN" {
+		t.Errorf("Client interceptor saw %v", sent)
+	}
+
+	if err := conn.SendEvent("BLOCKED", nil); err == nil {
+		t.Error("Expected client event interceptor to refuse event")
+	}
+	conn.SendEvent("DROPPED", nil)
+	conn.SendEvent("KEPT", nil)
+	// the request round trip orders it after both events
+	Call[int](conn, "INTTEST", 1, 1)
+	mu.Lock()
+	got = strings.Join(trace, " ")
+	mu.Unlock()
+	if strings.Contains(got, "DROPPED") || !strings.Contains(got, "event KEPT") {
+		t.Errorf("Unexpected events delivered: %q", got)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	events := make(chan *Event, 1)
+	s := NewServer(PipeTransport(), &Options{
+		Logger: os.Stdout,
+		ConnectionHandler: func(conn *Conn) error {
+			conn.OnRequest(func(req *Request, res *Response) {
+				md := IncomingMetadata(req.Context())
+				res.SetTrailer("seen", md.Get("tenant") + "/" + req.Metadata.Get("trace"))
+				res.Send(len(req.Metadata))
+			})
+			conn.OnEvent(func(evt *Event) {
+				events <- evt
+			})
+			return nil
+		},
+	})
+	if err := s.Listen("armie-metadata"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn, err := NewPipeConnection("armie-metadata", os.Stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetMetadata(Metadata{"tenant": "acme", "trace": "default"})
+	ctx := WithMetadata(context.Background(), Metadata{"trace": "t1"})
+	f, err := conn.SendRequestContext(ctx, "ANYTHING")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := f.GetResult(&n); err != nil || n != 2 {
+		t.Fatalf("Expected 2 metadata entries, got %v, %v", n, err)
+	}
+	if seen := f.Trailer().Get("seen"); seen != "acme/t1" {
+		t.Errorf("Unexpected trailer %q", seen)
+	}
+
+	conn.SendEventContext(WithMetadata(context.Background(), Metadata{"trace": "t2"}), "ARRIVED", "Joe")
+	select {
+	case evt := <-events:
+		if evt.Metadata.Get("trace") != "t2" || evt.Metadata.Get("tenant") != "acme" {
+			t.Errorf("Unexpected event metadata %v", evt.Metadata)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Event not delivered")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	peers := make(chan *PeerInfo, 1)
+	s := NewServer(PipeTransport(), &Options{
+		Logger: os.Stdout,
+		Name: "server",
+		ConnectionHandler: func(conn *Conn) error {
+			peers <- conn.PeerInfo()
+			conn.OnRequest(handleRequest)
+			return nil
+		},
+	})
+	if err := s.Listen("armie-handshake"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := Dial(PipeTransport(), "armie-handshake", &Options{
+		Logger: os.Stdout,
+		Name: "client",
+		Capabilities: []string{"x-test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := conn.PeerInfo(); info.Name != "server" || info.Version != ProtocolVersion {
+		t.Errorf("Unexpected server info %+v", info)
+	}
+	if info := <-peers; info.Name != "client" || !info.HasCapability("x-test") {
+		t.Errorf("Unexpected client info %+v", info)
+	}
+
+	// a peer that predates the handshake gets an error for its request
+	tc, err := PipeTransport().Dial("armie-handshake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := newConnection(tc.Socket, tc.Address, log.New(os.Stdout), &Options{})
+	go legacy.serve()
+	_, err = Call[int](legacy, "INTTEST", 1, 2)
+	if !errors.Is(err, CodeFailedPrecondition) {
+		t.Errorf("Expected legacy client to be refused, got %v", err)
+	}
+
+	// an unsupported version is refused with a hello carrying the reason
+	tc, err = PipeTransport().Dial("armie-handshake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := newConnection(tc.Socket, tc.Address, log.New(os.Stdout), &Options{})
+	go encodeHello(old, &PeerInfo{Version: 0, Codecs: []string{"msgpack"}}, nil)
+	frm, err := readFrame(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frm.Type != HELLO || Code(frm.Code) != CodeFailedPrecondition {
+		t.Errorf("Expected refusal, got %+v", frm)
+	}
+	select {
+	case <-peers:
+		t.Error("ConnectionHandler ran for a refused peer")
+	default:
+	}
+}
+
+func TestAuthenticators(t *testing.T) {
+	s := NewServer(PipeTransport(), &Options{
+		Logger: os.Stdout,
+		Authenticator: BearerAuthenticator(func(token string) (*Identity, error) {
+			if token != "s3cret" {
+				return nil, errors.New("bad token")
+			}
+			return &Identity{Name: "alice", Roles: []string{"admin"}}, nil
+		}),
+		ConnectionHandler: func(conn *Conn) error {
+			conn.OnRequest(func(req *Request, res *Response) {
+				id := req.Identity()
+				res.Send(id.Name + " " + id.Scheme + " " + strconv.FormatBool(id.HasRole("admin")))
+			})
+			return nil
+		},
+	})
+	if err := s.Listen("armie-bearer"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := Dial(PipeTransport(), "armie-bearer", &Options{Credentials: BearerCredentials("s3cret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if who, err := Call[string](conn, "WHOAMI"); err != nil || who != "alice bearer true" {
+		t.Errorf("Got %q, %v", who, err)
+	}
+
+	for _, opts := range []*Options{
+		{Credentials: BearerCredentials("wrong")},
+		{Credentials: HMACCredentials("alice", []byte("s3cret"))},
+		{},
+	} {
+		_, err = Dial(PipeTransport(), "armie-bearer", opts)
+		if !errors.Is(err, CodeUnauthenticated) {
+			t.Errorf("Expected unauthenticated, got %v", err)
+		}
+	}
+
+	h := NewServer(PipeTransport(), &Options{
+		Authenticator: HMACAuthenticator(map[string][]byte{"bob": []byte("shared")}),
+		ConnectionHandler: func(conn *Conn) error {
+			conn.OnRequest(func(req *Request, res *Response) {
+				res.Send(conn.Identity().Name)
+			})
+			return nil
+		},
+	})
+	if err := h.Listen("armie-hmac"); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	conn, err = Dial(PipeTransport(), "armie-hmac", &Options{Credentials: HMACCredentials("bob", []byte("shared"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if who, err := Call[string](conn, "WHOAMI"); err != nil || who != "bob" {
+		t.Errorf("Got %q, %v", who, err)
+	}
+	_, err = Dial(PipeTransport(), "armie-hmac", &Options{Credentials: HMACCredentials("bob", []byte("guess"))})
+	if !errors.Is(err, CodeUnauthenticated) {
+		t.Errorf("Expected unauthenticated, got %v", err)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	tokens := map[string]*Identity{
+		"a": {Name: "alice", Roles: []string{"admin"}},
+		"b": {Name: "bob"},
+	}
+	events := make(chan string, 4)
+	s := NewServer(PipeTransport(), &Options{
+		Logger: os.Stdout,
+		Authenticator: BearerAuthenticator(func(token string) (*Identity, error) {
+			return tokens[token], nil
+		}),
+		Policy: &Policy{
+			Allow: []Rule{
+				{Methods: []string{"INTTEST", "STRINGTEST"}, Events: []string{"PUBLIC.*"}},
+				{Roles: []string{"admin"}, Methods: []string{"*"}, Events: []string{"*"}},
+			},
+			Deny: []Rule{
+				{Identities: []string{"alice"}, Methods: []string{"STRINGTEST"}},
+			},
+		},
+		ConnectionHandler: func(conn *Conn) error {
+			conn.OnRequest(handleRequest)
+			conn.OnEvent(func(evt *Event) {
+				events <- conn.Identity().Name + " " + evt.Event
+			})
+			return nil
+		},
+	})
+	if err := s.Listen("armie-policy"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	alice, err := Dial(PipeTransport(), "armie-policy", &Options{Credentials: BearerCredentials("a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := Dial(PipeTransport(), "armie-policy", &Options{Credentials: BearerCredentials("b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tc := range []struct {
+		conn   *Conn
+		method string
+		ok     bool
+	}{
+		{alice, "INTTEST", true},
+		{alice, "OBJRETTEST", true},
+		{alice, "STRINGTEST", false},
+		{bob, "INTTEST", true},
+		{bob, "STRINGTEST", true},
+		{bob, "OBJRETTEST", false},
+	} {
+		f, err := tc.conn.SendRequest(tc.method, 1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.GetResult(nil)
+		if errors.Is(err, CodePermissionDenied) == tc.ok {
+			t.Errorf("%s %d: unexpected result %v", tc.method, i, err)
+		}
+	}
+
+	bob.SendEvent("SECRET", nil)
+	bob.SendEvent("PUBLIC.NEWS", nil)
+	alice.SendEvent("SECRET", nil)
+	got := []string{<-events, <-events}
+	sort.Strings(got)
+	if got[0] != "alice SECRET" || got[1] != "bob PUBLIC.NEWS" {
+		t.Errorf("Unexpected events %v", got)
+	}
+}
+
+func TestServerStreaming(t *testing.T) {
+	stopped := make(chan error, 1)
+	s := NewServer(PipeTransport(), &Options{
+		Logger: os.Stdout,
+		Dispatch: DispatchGoroutine,
+		ConnectionHandler: func(conn *Conn) error {
+			conn.OnRequest(func(req *Request, res *Response) {
+				switch req.Method {
+				case "COUNT":
+					var n int
+					req.CallMethod(func(count int) { n = count })
+					stream := res.Stream()
+					for i := 0; i < n; i++ {
+						stream.Send(i)
+					}
+					res.SetTrailer("count", strconv.Itoa(n))
+					stream.Close()
+				case "FAIL":
+					stream := res.Stream()
+					stream.Send("partial")
+					stream.CloseWithError(Errorf(CodeAborted, "gave up"))
+				case "FOREVER":
+					stream := res.Stream()
+					for {
+						if err := stream.Send("tick"); err != nil {
+							stopped <- err
+							stream.Close()
+							return
+						}
+						time.Sleep(time.Millisecond)
+					}
+				default:
+					res.Send("single")
+				}
+			})
+			return nil
+		},
+	})
+	if err := s.Listen("armie-streaming"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn, err := NewPipeConnection("armie-streaming", os.Stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	stream, err := conn.SendStreamRequest(ctx, "COUNT", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		var n int
+		if err := stream.Recv(&n); err != nil || n != i {
+			t.Fatalf("Expected %d, got %d, %v", i, n, err)
+		}
+	}
+	if err := stream.Recv(nil); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+	if stream.Trailer().Get("count") != "5" {
+		t.Errorf("Unexpected trailer %v", stream.Trailer())
+	}
+
+	stream, _ = conn.SendStreamRequest(ctx, "FAIL")
+	var msg string
+	if err := stream.Recv(&msg); err != nil || msg != "partial" {
+		t.Errorf("Got %q, %v", msg, err)
+	}
+	if err := stream.Recv(&msg); !errors.Is(err, CodeAborted) {
+		t.Errorf("Expected aborted, got %v", err)
+	}
+
+	stream, _ = conn.SendStreamRequest(ctx, "SINGLE")
+	if err := stream.Recv(&msg); err != nil || msg != "single" {
+		t.Errorf("Got %q, %v", msg, err)
+	}
+	if err := stream.Recv(&msg); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+
+	stream, _ = conn.SendStreamRequest(ctx, "FOREVER")
+	if err := stream.Recv(&msg); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	if err := stream.Recv(&msg); err != ErrStreamClosed {
+		t.Errorf("Expected ErrStreamClosed, got %v", err)
+	}
+	select {
+	case err := <-stopped:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Handler stopped with %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Handler not cancelled")
+	}
+}
+
+func TestBidiStreams(t *testing.T) {
+	s := NewServer(PipeTransport(), &Options{
+		Logger: os.Stdout,
+		Dispatch: DispatchGoroutine,
+	})
+	// echo each message with a prefix, then report the count
+	s.RegisterStream("ECHO", func(req *Request, stream *ServerStream) error {
+		var prefix string
+		req.CallMethod(func(p string) { prefix = p })
+		n := 0
+		for {
+			var msg string
+			err := stream.Recv(&msg)
+			if err == io.EOF {
+				return stream.Send(n)
+			}
+			if err != nil {
+				return err
+			}
+			n++
+			stream.Send(prefix + msg)
+		}
+	})
+	cancelled := make(chan error, 1)
+	s.RegisterStream("FOUR", func(req *Request, stream *ServerStream) error {
+		for i := 0; i < 4; i++ {
+			stream.Send(strings.Repeat("x", 1000))
+		}
+		return nil
+	})
+	s.RegisterStream("WAIT", func(req *Request, stream *ServerStream) error {
+		err := stream.Recv(nil)
+		cancelled <- err
+		return err
+	})
+	if err := s.Listen("armie-bidi"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn, err := NewPipeConnection("armie-bidi", os.Stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err := conn.OpenStream(context.Background(), "ECHO", "> ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, word := range []string{"a", "b", "c"} {
+		if err := stream.Send(word); err != nil {
+			t.Fatal(err)
+		}
+		var echo string
+		if err := stream.Recv(&echo); err != nil || echo != "> " + word {
+			t.Fatalf("Got %q, %v", echo, err)
+		}
+	}
+	stream.CloseSend()
+	if err := stream.Send("late"); !errors.Is(err, ErrStreamClosed) {
+		t.Errorf("Expected send after CloseSend to fail, got %v", err)
+	}
+	var n int
+	if err := stream.Recv(&n); err != nil || n != 3 {
+		t.Errorf("Expected count 3, got %d, %v", n, err)
+	}
+	if err := stream.Recv(nil); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+
+	// closing a finished stream still discards its messages, and
+	// returns their flow control credit
+	stream, err = conn.SendStreamRequest(context.Background(), "FOUR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Recv(nil); err != nil {
+		t.Fatal(err)
+	}
+	<-stream.in.done
+	conn.flow.mu.Lock()
+	unacked := conn.flow.connUnacked
+	conn.flow.mu.Unlock()
+	stream.Close()
+	if err := stream.Recv(nil); err != ErrStreamClosed {
+		t.Errorf("Expected ErrStreamClosed after Close, got %v", err)
+	}
+	conn.flow.mu.Lock()
+	returned := conn.flow.connUnacked - unacked
+	conn.flow.mu.Unlock()
+	if want := int64(3 * len(encodeBytes(strings.Repeat("x", 1000)))); returned != want {
+		t.Errorf("Close returned %d bytes of credit, expected %d", returned, want)
+	}
+
+	stream, err = conn.OpenStream(context.Background(), "WAIT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	select {
+	case err := <-cancelled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Handler Recv returned %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Handler not cancelled")
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	serverConns := make(chan *Conn, 1)
+	var received int32
+	s := NewServer(PipeTransport(), &Options{
+		Logger: os.Stdout,
+		Dispatch: DispatchGoroutine,
+		OrderedEvents: true,
+		ConnWindow: 128,
+		StreamWindow: 64,
+		ConnectionHandler: func(conn *Conn) error {
+			// a slow consumer of events
+			conn.OnEvent(func(evt *Event) {
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt32(&received, 1)
+			})
+			serverConns <- conn
+			return nil
+		},
+	})
+	s.RegisterStream("COUNT", func(req *Request, stream *ServerStream) error {
+		for i := 0; i < 20; i++ {
+			if err := stream.Send(fmt.Sprintf("message %d", i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err := s.Listen("armie-flow"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := Dial(PipeTransport(), "armie-flow", &Options{
+		Logger: os.Stdout,
+		ConnWindow: 128,
+		StreamWindow: 64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	serverConn := <-serverConns
+
+	for i := 0; i < 20; i++ {
+		if err := conn.SendEvent("EVT", fmt.Sprintf("event number %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := conn.FlowStats(); stats.Blocked == 0 || stats.BlockedTime == 0 {
+		t.Errorf("Expected event sender to block, got %+v", stats)
+	}
+
+	stream, err := conn.SendStreamRequest(context.Background(), "COUNT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		// a slow consumer of stream messages
+		time.Sleep(5 * time.Millisecond)
+		var msg string
+		err := stream.Recv(&msg)
+		if err == io.EOF {
+			if i != 20 {
+				t.Errorf("Expected 20 messages, got %d", i)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg != fmt.Sprintf("message %d", i) {
+			t.Fatalf("Got %q, expected message %d", msg, i)
+		}
+	}
+	if stats := serverConn.FlowStats(); stats.Blocked == 0 || stats.BlockedTime == 0 {
+		t.Errorf("Expected stream sender to block, got %+v", stats)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&received) < 20 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&received); n != 20 {
+		t.Errorf("Expected 20 events, got %d", n)
+	}
+
+	unlimited, err := Dial(PipeTransport(), "armie-flow", &Options{
+		Logger: os.Stdout,
+		ConnWindow: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlimited.Close()
+	<-serverConns
+	for i := 0; i < 20; i++ {
+		unlimited.SendEvent("EVT", fmt.Sprintf("event number %d", i))
+	}
+	if stats := unlimited.FlowStats(); stats.Blocked != 0 {
+		t.Errorf("Expected no flow control, got %+v", stats)
+	}
+}
+
+func TestStreamClientInterceptors(t *testing.T) {
+	s := NewServer(PipeTransport(), &Options{Logger: os.Stdout})
+	s.RegisterStream("TRACE", func(req *Request, stream *ServerStream) error {
+		return stream.Send(req.Metadata.Get("trace"))
+	})
+	if err := s.Listen("armie-stream-interceptors"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn, err := NewPipeConnection("armie-stream-interceptors", os.Stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var methods []string
+	ended := make(chan error, 1)
+	conn.UseClient(func(ctx context.Context, method string, args []interface{}, next SendRequestFunc) (*Future, error) {
+		methods = append(methods, method)
+		if method == "DENIED" {
+			return nil, Errorf(CodePermissionDenied, "no")
+		}
+		f, err := next(WithMetadata(ctx, Metadata{"trace": "t1"}), method, args)
+		if err == nil {
+			go func() { ended <- f.GetResult(nil) }()
+		}
+		return f, err
+	})
+
+	stream, err := conn.SendStreamRequest(context.Background(), "TRACE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trace string
+	if err := stream.Recv(&trace); err != nil || trace != "t1" {
+		t.Errorf("Got trace %q, %v", trace, err)
+	}
+	if err := stream.Recv(nil); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+	select {
+	case err := <-ended:
+		if err != nil {
+			t.Errorf("Interceptor's Future failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Interceptor's Future did not complete with the stream")
+	}
+
+	if _, err := conn.OpenStream(context.Background(), "DENIED"); !errors.Is(err, CodePermissionDenied) {
+		t.Errorf("Expected the interceptor to refuse the stream, got %v", err)
+	}
+	if len(methods) != 2 || methods[0] != "TRACE" || methods[1] != "DENIED" {
+		t.Errorf("Interceptor saw %v", methods)
+	}
+}
+
+func TestFlowControlFromInlineHandler(t *testing.T) {
+	release := make(chan struct{})
+	var received int32
+	s := NewServer(TCPTransport(), &Options{
+		Logger: os.Stdout,
+		ConnWindow: 4096,
+		ConnectionHandler: func(conn *Conn) error {
+			// sends back to the peer from an inline handler, well
+			// beyond the window the peer granted
+			conn.OnRequest(func(req *Request, res *Response) {
+				chunk := strings.Repeat("x", 1024)
+				for i := 0; i < 20; i++ {
+					if err := conn.SendEvent("CHUNK", chunk); err != nil {
+						res.SendError(err)
+						return
+					}
+				}
+				res.Send(nil)
+			})
+			return nil
+		},
+	})
+	if err := s.Listen("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	defer func() {
+		go func() {
+			s.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(2 * time.Second):
+			t.Error("Server.Close hung")
+		}
+		close(release)
+	}()
+
+	dial := func(consume func()) *Conn {
+		conn, err := Dial(TCPTransport(), s.listener.Addr().String(), &Options{
+			Logger: os.Stdout,
+			ConnWindow: 4096,
+			ConnectionHandler: func(conn *Conn) error {
+				conn.OnEvent(func(evt *Event) { consume() })
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	conn := dial(func() { atomic.AddInt32(&received, 1) })
+	defer conn.Close()
+	f, err := conn.SendRequest("BLAST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2 * time.Second)
+	defer cancel()
+	if err := f.GetResultContext(ctx, nil); err != nil {
+		t.Fatalf("Handler sending events did not finish: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&received) < 20 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&received); n != 20 {
+		t.Errorf("Got %d events", n)
+	}
+
+	// a peer that stops reading leaves the handler waiting for
+	// credit, until the Server closes
+	stuck := dial(func() { <-release })
+	defer stuck.Close()
+	stuck.SendRequest("BLAST")
+	time.Sleep(50 * time.Millisecond)
+}
+
+func TestInlineRequestsBeyondQueueDepth(t *testing.T) {
+	s := NewTCPServer(os.Stdout)
+	s.OnConnection(func(conn *Conn) error {
+		conn.OnRequest(func(req *Request, res *Response) {
+			time.Sleep(time.Millisecond)
+			res.Send(nil)
+		})
+		return nil
+	})
+	if err := s.Listen("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn, err := NewTCPConnection(s.listener.Addr().String(), os.Stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	futures := make([]*Future, defaultQueueDepth * 3)
+	for i := range futures {
+		futures[i], err = conn.SendRequest("SLEEP")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, f := range futures {
+		if err := f.GetResult(nil); err != nil {
+			t.Errorf("Request %d: %v", i, err)
+		}
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, topic string
+		match bool
+	}{
+		{"orders.eu.created", "orders.eu.created", true},
+		{"orders.*.created", "orders.eu.created", true},
+		{"orders.*", "orders.eu.created", false},
+		{"orders.>", "orders.eu.created", true},
+		{"orders.>", "orders", false},
+		{"*.eu.>", "orders.eu.created", true},
+		{"orders.eu", "orders.eu.created", false},
+	} {
+		if MatchTopic(tc.pattern, tc.topic) != tc.match {
+			t.Errorf("MatchTopic(%q, %q) != %v", tc.pattern, tc.topic, tc.match)
+		}
+	}
+
+	s := NewServer(PipeTransport(), &Options{Logger: os.Stdout})
+	if err := s.Listen("armie-pubsub"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	subscriber := func() (*Conn, chan string) {
+		events := make(chan string, 50)
+		conn, err := Dial(PipeTransport(), "armie-pubsub", &Options{
+			Logger: os.Stdout,
+			ConnectionHandler: func(conn *Conn) error {
+				conn.OnEvent(func(evt *Event) {
+					var msg string
+					evt.Decode(&msg)
+					events <- evt.Event + ":" + msg
+				})
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, events
+	}
+	expect := func(events chan string, want string) {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Errorf("Got event %q, expected %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("No event, expected %q", want)
+		}
+	}
+
+	all, allEvents := subscriber()
+	defer all.Close()
+	eu, euEvents := subscriber()
+	if err := all.Subscribe("orders.>"); err != nil {
+		t.Fatal(err)
+	}
+	for _, pattern := range []string{"orders.*.created", "orders.eu.*"} {
+		if err := eu.Subscribe(pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := eu.Subscribe("orders.>.created"); err == nil {
+		t.Error("Expected bad pattern to be refused")
+	}
+
+	if n := s.Publish("orders.eu.created", "1"); n != 2 {
+		t.Errorf("Published to %d subscribers, expected 2", n)
+	}
+	expect(allEvents, "orders.eu.created:1")
+	expect(euEvents, "orders.eu.created:1")
+	if n := s.Publish("orders.us.shipped", "2"); n != 1 {
+		t.Errorf("Published to %d subscribers, expected 1", n)
+	}
+	expect(allEvents, "orders.us.shipped:2")
+
+	if err := all.Unsubscribe("orders.>"); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Publish("orders.eu.created", "3"); n != 1 {
+		t.Errorf("Published to %d subscribers, expected 1", n)
+	}
+	expect(euEvents, "orders.eu.created:3")
+
+	eu.Close()
+	deadline := time.Now().Add(time.Second)
+	for s.Publish("orders.eu.created", "4") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Subscription not dropped on disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case evt := <-allEvents:
+		t.Errorf("Unexpected event %q after unsubscribing", evt)
+	default:
+	}
+
+	// a subscriber that stops reading is skipped, not waited for
+	release := make(chan struct{})
+	slow, err := Dial(PipeTransport(), "armie-pubsub", &Options{
+		Logger: os.Stdout,
+		ConnWindow: 256,
+		ConnectionHandler: func(conn *Conn) error {
+			conn.OnEvent(func(evt *Event) { <-release })
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	defer close(release)
+	slow.Subscribe("orders.>")
+	all.Subscribe("orders.>")
+
+	published := make(chan []int, 1)
+	go func() {
+		var counts []int
+		for i := 0; i < 20; i++ {
+			counts = append(counts, s.Publish("orders.eu.created", strings.Repeat("x", 100)))
+		}
+		published <- counts
+	}()
+	select {
+	case counts := <-published:
+		if counts[0] != 2 || counts[len(counts)-1] != 1 {
+			t.Errorf("Expected the slow subscriber to be skipped once its window filled: %v", counts)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Publish blocked on a slow subscriber")
+	}
+}
+
+func TestEventMux(t *testing.T) {
+	got := make(chan string, 20)
+	errs := make(chan error, 5)
+	mux := NewEventMux()
+	mux.ErrorHandler = func(evt *Event, err error) {
+		errs <- err
+	}
+	mux.On("user.created", func(p person) {
+		got <- "created " + p.Name
+	})
+	mux.On("user.*", func(evt *Event, p *person) error {
+		got <- evt.Event + " " + p.Name
+		if p.Age < 0 {
+			return errors.New("negative age")
+		}
+		return nil
+	})
+	all, _ := mux.On(">", func(evt *Event) {
+		got <- "any " + evt.Event
+	})
+	mux.On("user.deleted", func(id int) {
+		got <- "deleted " + strconv.Itoa(id)
+	})
+	if _, err := mux.On("user.*", func(a, b, c int) {}); err == nil {
+		t.Error("Expected handler with too many arguments to be refused")
+	}
+	if _, err := mux.On("user.>.x", func(evt *Event) {}); err == nil {
+		t.Error("Expected bad pattern to be refused")
+	}
+
+	s := NewServer(PipeTransport(), &Options{
+		Logger: os.Stdout,
+		ConnectionHandler: func(conn *Conn) error {
+			conn.OnEvent(mux.HandleEvent)
+			return nil
+		},
+	})
+	if err := s.Listen("armie-eventmux"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn, err := NewPipeConnection("armie-eventmux", os.Stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expect := func(want ...string) {
+		for _, w := range want {
+			select {
+			case g := <-got:
+				if g != w {
+					t.Errorf("Got %q, expected %q", g, w)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Timed out waiting for %q", w)
+			}
+		}
+	}
+
+	conn.SendEvent("user.created", person{30, "ann"})
+	expect("created ann", "user.created ann", "any user.created")
+	conn.SendEvent("user.updated", person{-1, "bob"})
+	expect("user.updated bob", "any user.updated")
+	if err := <-errs; err.Error() != "negative age" {
+		t.Errorf("Unexpected handler error %v", err)
+	}
+
+	all.Off()
+	conn.SendEvent("user.deleted", 7)
+	expect("deleted 7")
+	// the person handler cannot decode an int
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "decoding user.deleted") {
+			t.Errorf("Unexpected decoding error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected a decoding error")
+	}
+	conn.SendEvent("other", "x")
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case g := <-got:
+		t.Errorf("Unexpected %q after Off", g)
+	default:
+	}
+}
+
+func testLocalTransport(t *testing.T, s *Server, addr string, dial func() (*Conn, error)) {
+	s.OnConnection(func(conn *Conn) error {
+		conn.OnRequest(handleRequest)
+		return nil
+	})
+	if err := s.Listen(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	f, err := conn.SendRequest("OBJTEST", &person{Name: "ann", Age: 31})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res string
+	if err := f.GetResult(&res); err != nil || res != "ann is 31" {
+		t.Errorf("Got %q, %v", res, err)
+	}
+
+	// pipelined, so responses are written while requests still are
+	futures := make([]*Future, 200)
+	for i := range futures {
+		futures[i], err = conn.SendRequest("INTTEST", i, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, f := range futures {
+		var n int
+		if err := f.GetResult(&n); err != nil || n != i*2 {
+			t.Errorf("Request %d: got %d, %v", i, n, err)
+		}
+	}
+}
+
+// a third-party Transport layered over another one
+type countingTransport struct {
+	Transport
+	dials int
+}
+
+func (t *countingTransport) Dial(address string) (*TransportConn, error) {
+	t.dials++
+	return t.Transport.Dial(address)
+}
+
+func TestCustomTransport(t *testing.T) {
+	tr := &countingTransport{Transport: PipeTransport()}
+	s := NewServer(tr, &Options{
+		Logger: os.Stdout,
+		ConnectionHandler: func(conn *Conn) error {
+			conn.OnRequest(handleRequest)
+			return nil
+		},
+	})
+	if err := s.Listen("armie-custom"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := Dial(tr, "armie-custom", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	f, err := conn.SendRequest("INTTEST", 6, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res int
+	if err := f.GetResult(&res); err != nil || res != 42 {
+		t.Errorf("Got %d, %v", res, err)
+	}
+	if tr.dials != 1 {
+		t.Errorf("Expected 1 dial, got %d", tr.dials)
+	}
+}
+
 func intTest(a, b int) int {
 	return a * b
 }
@@ -143,6 +2133,20 @@ func handleRequest(req *Request, response *Response) {
 			response.Error(err.Error())
 		}
 		response.Send(res)
+	case "SLOWTEST":
+		response.Detach()
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			response.Send(1)
+		}()
+	case "HANGTEST":
+		response.Detach()
+	case "CANCELTEST":
+		response.Detach()
+		go func() {
+			<-req.Context().Done()
+			cancel_observed <- req.Context().Err()
+		}()
 	}
 }
 
@@ -0,0 +1,280 @@
+package armie
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+)
+
+//
+// Who the peer is, as established by an Authenticator.
+//
+type Identity struct {
+	Name  string
+	Roles []string
+	// The Scheme of the Authenticator that established it.
+	Scheme string
+}
+
+func (id *Identity) HasRole(role string) bool {
+	if id == nil {
+		return false
+	}
+	for _, r := range id.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Sends challenge to the peer and returns its response.
+//
+type AuthExchange func(challenge []byte) (response []byte, err error)
+
+//
+// An Authenticator establishes the identity of a connecting peer
+// during the handshake, before the ConnectionHandler runs.  It may
+// exchange any number of challenges with the peer's Credentials.
+// Peers that fail are refused with a CodeUnauthenticated error; the
+// reason is logged but not sent.
+//
+type Authenticator interface {
+	Scheme() string
+	Authenticate(conn *Conn, exchange AuthExchange) (*Identity, error)
+}
+
+//
+// Credentials answer an Authenticator's challenges on the dialing
+// side.
+//
+type Credentials interface {
+	Scheme() string
+	Respond(conn *Conn, challenge []byte) ([]byte, error)
+}
+
+//
+// The identity established for the peer, or nil if the Conn was not
+// authenticated.
+//
+func (c *Conn) Identity() *Identity {
+	return c.identity
+}
+
+//
+// The identity of the peer that sent the request.  See Conn.Identity.
+//
+func (r *Request) Identity() *Identity {
+	return IdentityFromContext(r.Context())
+}
+
+type identityKey struct{}
+
+//
+// The identity of the peer that sent the request with the given
+// Request.Context().
+//
+func IdentityFromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
+
+//
+// Authenticate with bearer tokens checked by verify.
+//
+func BearerAuthenticator(verify func(token string) (*Identity, error)) Authenticator {
+	return bearerAuth(verify)
+}
+
+type bearerAuth func(token string) (*Identity, error)
+
+func (a bearerAuth) Scheme() string {
+	return "bearer"
+}
+
+func (a bearerAuth) Authenticate(conn *Conn, exchange AuthExchange) (*Identity, error) {
+	token, err := exchange(nil)
+	if err != nil {
+		return nil, err
+	}
+	return a(string(token))
+}
+
+//
+// Present token to a BearerAuthenticator.
+//
+func BearerCredentials(token string) Credentials {
+	return bearerCreds(token)
+}
+
+type bearerCreds string
+
+func (c bearerCreds) Scheme() string {
+	return "bearer"
+}
+
+func (c bearerCreds) Respond(conn *Conn, challenge []byte) ([]byte, error) {
+	return []byte(c), nil
+}
+
+//
+// Authenticate with a shared secret per peer name: the peer proves it
+// knows the secret by signing a random challenge, so the secret never
+// crosses the wire.  Identities carry the peer's name.
+//
+func HMACAuthenticator(secrets map[string][]byte) Authenticator {
+	return hmacAuth(secrets)
+}
+
+type hmacAuth map[string][]byte
+
+type hmacResponse struct {
+	Name string `codec:"n"`
+	MAC  []byte `codec:"m"`
+}
+
+func hmacSign(secret, challenge []byte, name string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(challenge)
+	mac.Write([]byte(name))
+	return mac.Sum(nil)
+}
+
+func (a hmacAuth) Scheme() string {
+	return "hmac-sha256"
+}
+
+func (a hmacAuth) Authenticate(conn *Conn, exchange AuthExchange) (*Identity, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+
+	res, err := exchange(challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	var hr hmacResponse
+	if err := decodeBytes(res, &hr); err != nil {
+		return nil, fmt.Errorf("malformed response: %v", err)
+	}
+	secret, ok := a[hr.Name]
+	if !ok {
+		return nil, fmt.Errorf("unknown peer %q", hr.Name)
+	}
+	if !hmac.Equal(hr.MAC, hmacSign(secret, challenge, hr.Name)) {
+		return nil, fmt.Errorf("bad signature from %q", hr.Name)
+	}
+	return &Identity{Name: hr.Name}, nil
+}
+
+//
+// Answer an HMACAuthenticator as name.
+//
+func HMACCredentials(name string, secret []byte) Credentials {
+	return &hmacCreds{name, secret}
+}
+
+type hmacCreds struct {
+	name   string
+	secret []byte
+}
+
+func (c *hmacCreds) Scheme() string {
+	return "hmac-sha256"
+}
+
+func (c *hmacCreds) Respond(conn *Conn, challenge []byte) ([]byte, error) {
+	return encodeBytes(&hmacResponse{
+		Name: c.name,
+		MAC:  hmacSign(c.secret, challenge, c.name),
+	}), nil
+}
+
+//
+// Authenticate by the peer's verified TLS client certificate; the
+// tls.Config must verify client certificates.  identify maps the leaf
+// certificate to an Identity; if nil, the Identity is named after the
+// certificate's common name.  No Credentials are needed.
+//
+func TLSAuthenticator(identify func(cert *x509.Certificate) (*Identity, error)) Authenticator {
+	return tlsAuth(identify)
+}
+
+type tlsAuth func(cert *x509.Certificate) (*Identity, error)
+
+func (a tlsAuth) Scheme() string {
+	return "tls"
+}
+
+func (a tlsAuth) Authenticate(conn *Conn, exchange AuthExchange) (*Identity, error) {
+	chains := conn.VerifiedChains()
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil, fmt.Errorf("no verified client certificate")
+	}
+	leaf := chains[0][0]
+	if a == nil {
+		return &Identity{Name: leaf.Subject.CommonName}, nil
+	}
+	return a(leaf)
+}
+
+//
+// Run the Authenticator as part of acceptHandshake.
+//
+func (c *Conn) authenticate(auth Authenticator) (*Identity, error) {
+	scheme := auth.Scheme()
+	exchange := func(challenge []byte) ([]byte, error) {
+		if err := encodeAuth(c, scheme, challenge, ""); err != nil {
+			return nil, err
+		}
+		frm, err := c.readHello()
+		if err != nil {
+			return nil, err
+		}
+		if frm.Type != AUTH {
+			return nil, fmt.Errorf("expected auth response, got frame type %d", frm.Type)
+		}
+		if frm.Error != "" {
+			return nil, fmt.Errorf("peer cannot authenticate: %s", frm.Error)
+		}
+		return frm.Payload, nil
+	}
+
+	id, err := auth.Authenticate(c, exchange)
+	if err != nil {
+		return nil, err
+	}
+	if id == nil {
+		return nil, fmt.Errorf("no identity established")
+	}
+	id.Scheme = scheme
+	return id, nil
+}
+
+//
+// Answer an auth challenge as part of handshake.
+//
+func (c *Conn) respondAuth(frm *frame) error {
+	creds := c.opts.Credentials
+	var res []byte
+	var err error
+	switch {
+	case creds == nil:
+		err = fmt.Errorf("no credentials for %q", frm.Method)
+	case creds.Scheme() != frm.Method:
+		err = fmt.Errorf("have credentials for %q, not %q", creds.Scheme(), frm.Method)
+	default:
+		res, err = creds.Respond(c, frm.Payload)
+	}
+	if err != nil {
+		c.logger.Warn("[RPC] cannot authenticate to %v: %v", c.addr, err)
+		return encodeAuth(c, frm.Method, nil, err.Error())
+	}
+	return encodeAuth(c, frm.Method, res, "")
+}
@@ -0,0 +1,367 @@
+//
+// armie-gen generates a typed client stub and a server RequestHandler
+// from a Go interface, so RMI method names and argument types are
+// checked at compile time.
+//
+// Usage:
+//
+//	armie-gen -type Greeter [-service Greeter] [-o greeter_armie.go] [file.go]
+//
+// or, from a go:generate directive in the file declaring Greeter:
+//
+//	//go:generate armie-gen -type Greeter
+//
+// Every method of the interface must return an error as its last
+// result, and at most one other value.  A leading context.Context
+// parameter is passed through to SendRequestContext on the client, and
+// receives Request.Context() on the server.  Packages used by the
+// interface must be imported under their own name or by a path ending
+// in it; name any other import explicitly.  Methods are exposed as
+// "Service.Method", matching Conn.Register and Server.Register, so the
+// generated client also works against an implementation registered
+// with Register.
+//
+// For an interface Greeter, the generated file contains:
+//
+//	type GreeterClient struct{ ... }                   // implements Greeter
+//	func NewGreeterClient(conn armie.Requester) *GreeterClient
+//	func NewGreeterHandler(impl Greeter) armie.RequestHandler
+//
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	typeName := flag.String("type", "", "interface to generate code for (required)")
+	service := flag.String("service", "", "RMI service name (default: the interface name)")
+	output := flag.String("o", "", "output file (default: <type>_armie.go)")
+	flag.Parse()
+
+	source := os.Getenv("GOFILE")
+	if flag.NArg() > 0 {
+		source = flag.Arg(0)
+	}
+	if *typeName == "" || source == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	src, err := os.ReadFile(source)
+	if err != nil {
+		fatal(err)
+	}
+
+	code, err := generate(source, src, *typeName, *service)
+	if err != nil {
+		fatal(err)
+	}
+
+	out := *output
+	if out == "" {
+		out = filepath.Join(filepath.Dir(source), strings.ToLower(*typeName)+"_armie.go")
+	}
+	if err := os.WriteFile(out, code, 0644); err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "armie-gen: %v\n", err)
+	os.Exit(1)
+}
+
+type param struct {
+	name string
+	typ  string
+}
+
+type method struct {
+	name   string
+	hasCtx bool
+	params []param
+	result string // empty if the method only returns an error
+}
+
+type generator struct {
+	fset    *token.FileSet
+	file    *ast.File
+	imports map[string]string // name -> path, for imports used by the interface
+	buf     bytes.Buffer
+	err     error // the first package reference that could not be resolved
+}
+
+//
+// Generate the stub and handler for the interface typeName declared
+// in src.
+//
+func generate(filename string, src []byte, typeName, service string) ([]byte, error) {
+	if service == "" {
+		service = typeName
+	}
+
+	g := &generator{
+		fset:    token.NewFileSet(),
+		imports: make(map[string]string),
+	}
+
+	var err error
+	g.file, err = parser.ParseFile(g.fset, filename, src, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+
+	iface := g.findInterface(typeName)
+	if iface == nil {
+		return nil, fmt.Errorf("interface %s not found in %s", typeName, filename)
+	}
+
+	methods, err := g.methods(iface)
+	if err == nil {
+		err = g.err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", typeName, err)
+	}
+
+	g.emit(typeName, service, methods)
+
+	code, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting generated code: %v\n%s", err, g.buf.Bytes())
+	}
+	return code, nil
+}
+
+func (g *generator) findInterface(name string) *ast.InterfaceType {
+	for _, decl := range g.file.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			if ts.Name.Name != name {
+				continue
+			}
+			if it, ok := ts.Type.(*ast.InterfaceType); ok {
+				return it
+			}
+		}
+	}
+	return nil
+}
+
+func (g *generator) methods(iface *ast.InterfaceType) ([]method, error) {
+	var methods []method
+	for _, field := range iface.Methods.List {
+		ft, ok := field.Type.(*ast.FuncType)
+		if !ok || len(field.Names) == 0 {
+			return nil, fmt.Errorf("embedded interfaces are not supported")
+		}
+		m := method{name: field.Names[0].Name}
+
+		i := 0
+		for _, p := range ft.Params.List {
+			if _, ok := p.Type.(*ast.Ellipsis); ok {
+				return nil, fmt.Errorf("method %s: variadic parameters are not supported", m.name)
+			}
+			names := p.Names
+			if len(names) == 0 {
+				names = []*ast.Ident{nil}
+			}
+			for range names {
+				typ := g.typeString(p.Type)
+				if i == 0 && typ == "context.Context" {
+					m.hasCtx = true
+				} else {
+					m.params = append(m.params, param{"p" + strconv.Itoa(i), typ})
+				}
+				i++
+			}
+		}
+
+		var results []string
+		if ft.Results != nil {
+			for _, r := range ft.Results.List {
+				n := len(r.Names)
+				if n == 0 {
+					n = 1
+				}
+				for j := 0; j < n; j++ {
+					results = append(results, g.typeString(r.Type))
+				}
+			}
+		}
+		if len(results) == 0 || len(results) > 2 || results[len(results)-1] != "error" {
+			return nil, fmt.Errorf("method %s must return an error, optionally preceded by one value", m.name)
+		}
+		if len(results) == 2 {
+			m.result = results[0]
+		}
+
+		methods = append(methods, m)
+	}
+	return methods, nil
+}
+
+//
+// Print a type expression, noting any package it refers to.
+//
+func (g *generator) typeString(expr ast.Expr) string {
+	ast.Inspect(expr, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		if pkg, ok := sel.X.(*ast.Ident); ok {
+			g.useImport(pkg.Name)
+		}
+		return false
+	})
+
+	var buf bytes.Buffer
+	printer.Fprint(&buf, g.fset, expr)
+	return buf.String()
+}
+
+//
+// Note that the package name is used.  Without type information, an
+// import is only known to declare name if it is imported as name or
+// its path ends in name; other imports, like gopkg.in/yaml.v2, need an
+// explicit name.
+//
+func (g *generator) useImport(name string) {
+	for _, imp := range g.file.Imports {
+		path, _ := strconv.Unquote(imp.Path.Value)
+		impName := filepath.Base(path)
+		if imp.Name != nil {
+			impName = imp.Name.Name
+		}
+		if impName == name {
+			g.imports[name] = path
+			return
+		}
+	}
+	if g.err == nil {
+		g.err = fmt.Errorf("cannot tell which import declares package %s; import it as %s explicitly", name, name)
+	}
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+func (g *generator) emit(typeName, service string, methods []method) {
+	g.printf("// Code generated by armie-gen. DO NOT EDIT.\n\n")
+	g.printf("package %s\n\n", g.file.Name.Name)
+
+	g.printf("import (\n")
+	g.printf("\t\"context\"\n")
+	names := make([]string, 0, len(g.imports))
+	for name := range g.imports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := g.imports[name]
+		if name == "context" {
+			continue
+		}
+		if filepath.Base(path) == name {
+			g.printf("\t%q\n", path)
+		} else {
+			g.printf("\t%s %q\n", name, path)
+		}
+	}
+	g.printf("\n\t\"github.com/fred-lewis/armie\"\n)\n\n")
+
+	client := typeName + "Client"
+	g.printf("// %s calls a remote %s over an armie connection.\n", client, typeName)
+	g.printf("type %s struct {\n\tconn armie.Requester\n}\n\n", client)
+	g.printf("var _ %s = (*%s)(nil)\n\n", typeName, client)
+	g.printf("func New%s(conn armie.Requester) *%s {\n\treturn &%s{conn: conn}\n}\n\n", client, client, client)
+
+	for _, m := range methods {
+		g.emitClientMethod(client, service, m)
+	}
+
+	g.printf("// New%sHandler returns a RequestHandler that dispatches %s\n", typeName, service)
+	g.printf("// requests to impl.\n")
+	g.printf("func New%sHandler(impl %s) armie.RequestHandler {\n", typeName, typeName)
+	g.printf("\treturn func(req *armie.Request, res *armie.Response) {\n")
+	g.printf("\t\tswitch req.Method {\n")
+	for _, m := range methods {
+		g.emitHandlerCase(service, m)
+	}
+	g.printf("\t\tdefault:\n")
+	g.printf("\t\t\tres.SendError(armie.Errorf(armie.CodeUnimplemented, \"unknown method %%q\", req.Method))\n")
+	g.printf("\t\t}\n\t}\n}\n")
+}
+
+func (g *generator) signature(m method, withCtx bool) string {
+	var params []string
+	if withCtx {
+		params = append(params, "ctx context.Context")
+	}
+	for _, p := range m.params {
+		params = append(params, p.name+" "+p.typ)
+	}
+	results := "error"
+	if m.result != "" {
+		results = "(" + m.result + ", error)"
+	}
+	return "(" + strings.Join(params, ", ") + ") " + results
+}
+
+func (g *generator) emitClientMethod(client, service string, m method) {
+	g.printf("func (c *%s) %s%s {\n", client, m.name, g.signature(m, m.hasCtx))
+	if !m.hasCtx {
+		g.printf("\tctx := context.Background()\n")
+	}
+
+	args := []string{strconv.Quote(service + "." + m.name)}
+	for _, p := range m.params {
+		args = append(args, p.name)
+	}
+
+	if m.result != "" {
+		g.printf("\tvar res %s\n", m.result)
+		g.printf("\tf, err := c.conn.SendRequestContext(ctx, %s)\n", strings.Join(args, ", "))
+		g.printf("\tif err != nil {\n\t\treturn res, err\n\t}\n")
+		g.printf("\terr = f.GetResultContext(ctx, &res)\n")
+		g.printf("\treturn res, err\n}\n\n")
+	} else {
+		g.printf("\tf, err := c.conn.SendRequestContext(ctx, %s)\n", strings.Join(args, ", "))
+		g.printf("\tif err != nil {\n\t\treturn err\n\t}\n")
+		g.printf("\treturn f.GetResultContext(ctx, nil)\n}\n\n")
+	}
+}
+
+func (g *generator) emitHandlerCase(service string, m method) {
+	var args []string
+	if m.hasCtx {
+		args = append(args, "req.Context()")
+	}
+	for _, p := range m.params {
+		args = append(args, p.name)
+	}
+
+	g.printf("\t\tcase %q:\n", service+"."+m.name)
+	g.printf("\t\t\tres.Reply(req.CallMethod(func%s {\n", g.signature(m, false))
+	g.printf("\t\t\t\treturn impl.%s(%s)\n", m.name, strings.Join(args, ", "))
+	g.printf("\t\t\t}))\n")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strings"
+	"testing"
+)
+
+const greeterSource = `package greet
+
+import (
+	"context"
+	t "time"
+)
+
+type Person struct {
+	Name string
+	Age  int
+}
+
+type Greeter interface {
+	Hello(p *Person) (int, error)
+	Wait(ctx context.Context, d t.Duration) error
+	Names(limit, offset int) ([]string, error)
+}
+
+type Broken interface {
+	NoError(p *Person) int
+}
+`
+
+func TestGenerate(t *testing.T) {
+	code, err := generate("greet.go", []byte(greeterSource), "Greeter", "Greetings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(code)
+
+	if _, err := parser.ParseFile(token.NewFileSet(), "greeter_armie.go", code, 0); err != nil {
+		t.Fatalf("Generated code does not parse: %v\n%s", err, out)
+	}
+
+	for _, want := range []string{
+		"package greet",
+		`t "time"`,
+		"func NewGreeterClient(conn armie.Requester) *GreeterClient",
+		"func (c *GreeterClient) Hello(p0 *Person) (int, error)",
+		"func (c *GreeterClient) Wait(ctx context.Context, p1 t.Duration) error",
+		"func (c *GreeterClient) Names(p0 int, p1 int) ([]string, error)",
+		`c.conn.SendRequestContext(ctx, "Greetings.Hello", p0)`,
+		"func NewGreeterHandler(impl Greeter) armie.RequestHandler",
+		`case "Greetings.Wait":`,
+		"return impl.Wait(req.Context(), p1)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Generated code missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestGeneratedCodeTypeChecks(t *testing.T) {
+	code, err := generate("greet.go", []byte(greeterSource), "Greeter", "Greetings")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, src := range []struct {
+		name string
+		code []byte
+	}{
+		{"greet.go", []byte(greeterSource)},
+		{"greeter_armie.go", code},
+	} {
+		f, err := parser.ParseFile(fset, src.name, src.code, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+
+	// check against the armie package in this module, from source
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	if _, err := conf.Check("greet", fset, files, nil); err != nil {
+		t.Fatalf("Generated code does not type-check: %v\n%s", err, code)
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	if _, err := generate("greet.go", []byte(greeterSource), "Broken", ""); err == nil {
+		t.Error("Expected an error for a method without an error result")
+	}
+	if _, err := generate("greet.go", []byte(greeterSource), "Missing", ""); err == nil {
+		t.Error("Expected an error for a missing interface")
+	}
+
+	const yamlSource = `package conf
+
+import "gopkg.in/yaml.v2"
+
+type Loader interface {
+	Load(doc yaml.MapSlice) error
+}
+`
+	if _, err := generate("conf.go", []byte(yamlSource), "Loader", ""); err == nil || !strings.Contains(err.Error(), "package yaml") {
+		t.Errorf("Expected an error for an import not named after its path, got %v", err)
+	}
+	named := strings.Replace(yamlSource, `import "gopkg.in`, `import yaml "gopkg.in`, 1)
+	if code, err := generate("conf.go", []byte(named), "Loader", ""); err != nil || !strings.Contains(string(code), `yaml "gopkg.in/yaml.v2"`) {
+		t.Errorf("Got %v for an explicitly named import:\n%s", err, code)
+	}
+}
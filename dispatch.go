@@ -0,0 +1,229 @@
+package armie
+
+import "sync"
+
+//
+// How a Conn runs RequestHandlers and EventHandlers.
+//
+type DispatchMode int
+
+const (
+	// Run handlers one at a time, in arrival order.  With flow
+	// control in use, they run on a goroutine of their own, so the
+	// reader keeps handling responses and window updates meanwhile;
+	// no request is refused for waiting its turn.  Without, they run
+	// on the connection's reader goroutine: a slow handler delays
+	// every later frame, and a handler that waits on a request to its
+	// own peer deadlocks.
+	// StreamHandlers, which wait on frames the reader has yet to
+	// read, always get their own goroutine.
+	DispatchInline DispatchMode = iota
+	// Run each handler on its own goroutine.
+	DispatchGoroutine
+	// Run handlers on a fixed pool of Options.Workers goroutines per
+	// connection.  Up to Options.QueueDepth requests wait for a free
+	// worker; beyond that, requests are refused with an error.  Events
+	// have their own queue and workers, so they never wait behind
+	// requests.
+	DispatchPool
+)
+
+const (
+	defaultWorkers    = 8
+	defaultQueueDepth = 64
+)
+
+//
+// dispatcher hands decoded requests and events to handlers per the
+// configured DispatchMode.  Responses, cancels and other control
+// frames are always handled on the reader goroutine.
+//
+type dispatcher struct {
+	mode   DispatchMode
+	depth  int
+	tasks  chan func()
+	events chan func()
+	serial *serialQueue
+	stop   chan struct{}
+}
+
+//
+// The handlers of DispatchInline when run off the reader: a FIFO
+// drained by one goroutine.  It is not limited in length: flow
+// control limits waiting events, and requests, as when run on the
+// reader, are never refused.
+//
+type serialQueue struct {
+	mu    sync.Mutex
+	fns   []func()
+	ready chan struct{}
+}
+
+func newDispatcher(opts *Options) *dispatcher {
+	d := &dispatcher{
+		mode: opts.Dispatch,
+		stop: make(chan struct{}),
+	}
+
+	depth := opts.QueueDepth
+	if depth <= 0 {
+		depth = defaultQueueDepth
+	}
+	d.depth = depth
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	if d.mode == DispatchPool {
+		d.tasks = make(chan func(), depth)
+		for i := 0; i < workers; i++ {
+			go d.work(d.tasks)
+		}
+	}
+
+	switch {
+	case d.mode != DispatchInline && opts.OrderedEvents:
+		d.events = make(chan func(), depth)
+		go d.work(d.events)
+	case d.mode == DispatchPool:
+		// a queue of their own, so the reader never waits behind
+		// requests whose workers wait on responses it has yet to read
+		d.events = make(chan func(), depth)
+		for i := 0; i < workers; i++ {
+			go d.work(d.events)
+		}
+	}
+
+	return d
+}
+
+func (d *dispatcher) work(queue chan func()) {
+	for {
+		select {
+		case fn := <-queue:
+			fn()
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+//
+// Dispatch a request handler.  Returns false if the request was
+// refused because the pool's queue is full.
+//
+func (d *dispatcher) request(fn func()) bool {
+	if q := d.serial; q != nil {
+		q.mu.Lock()
+		q.push(fn)
+		q.mu.Unlock()
+		return true
+	}
+
+	switch d.mode {
+	case DispatchGoroutine:
+		go fn()
+	case DispatchPool:
+		select {
+		case d.tasks <- fn:
+		default:
+			return false
+		}
+	default:
+		fn()
+	}
+	return true
+}
+
+//
+// Dispatch a StreamHandler, as request but never on the reader
+// goroutine.
+//
+func (d *dispatcher) stream(fn func()) bool {
+	if d.mode == DispatchInline {
+		go fn()
+		return true
+	}
+	return d.request(fn)
+}
+
+//
+// Dispatch an event handler.  Events are never refused; when their
+// queue is full the reader waits, pushing back on the sender.
+//
+func (d *dispatcher) event(fn func()) {
+	if q := d.serial; q != nil {
+		q.mu.Lock()
+		q.push(fn)
+		q.mu.Unlock()
+		return
+	}
+
+	queue := d.events
+	switch {
+	case d.mode == DispatchInline:
+		fn()
+	case queue != nil:
+		select {
+		case queue <- fn:
+		case <-d.stop:
+		}
+	default:
+		go fn()
+	}
+}
+
+//
+// Move DispatchInline's handlers off the reader goroutine, once flow
+// control is in use: a handler waiting for credit would otherwise
+// keep the reader from reading the window update it waits for.
+//
+func (d *dispatcher) serialize() {
+	if d.mode != DispatchInline || d.serial != nil {
+		return
+	}
+	q := &serialQueue{ready: make(chan struct{}, 1)}
+	d.serial = q
+	go d.runSerial(q)
+}
+
+// Call with q.mu held.
+func (q *serialQueue) push(fn func()) {
+	q.fns = append(q.fns, fn)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (d *dispatcher) runSerial(q *serialQueue) {
+	for {
+		q.mu.Lock()
+		if len(q.fns) == 0 {
+			q.mu.Unlock()
+			select {
+			case <-q.ready:
+				continue
+			case <-d.stop:
+				return
+			}
+		}
+		fn := q.fns[0]
+		q.fns[0] = nil
+		q.fns = q.fns[1:]
+		q.mu.Unlock()
+
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+		fn()
+	}
+}
+
+func (d *dispatcher) close() {
+	close(d.stop)
+}
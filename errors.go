@@ -0,0 +1,194 @@
+package armie
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ugorji/go/codec"
+)
+
+//
+// Status codes carried by a RemoteError.  The values follow gRPC's
+// numbering; applications may use their own codes beyond these.  A
+// Code is itself an error, so errors.Is(err, armie.CodeNotFound)
+// reports whether err is a RemoteError with that code.
+//
+type Code int32
+
+const (
+	CodeCanceled Code = iota + 1
+	CodeUnknown
+	CodeInvalidArgument
+	CodeDeadlineExceeded
+	CodeNotFound
+	CodeAlreadyExists
+	CodePermissionDenied
+	CodeResourceExhausted
+	CodeFailedPrecondition
+	CodeAborted
+	CodeOutOfRange
+	CodeUnimplemented
+	CodeInternal
+	CodeUnavailable
+	CodeDataLoss
+	CodeUnauthenticated
+)
+
+var codeNames = map[Code]string{
+	CodeCanceled:           "canceled",
+	CodeUnknown:            "unknown",
+	CodeInvalidArgument:    "invalid argument",
+	CodeDeadlineExceeded:   "deadline exceeded",
+	CodeNotFound:           "not found",
+	CodeAlreadyExists:      "already exists",
+	CodePermissionDenied:   "permission denied",
+	CodeResourceExhausted:  "resource exhausted",
+	CodeFailedPrecondition: "failed precondition",
+	CodeAborted:            "aborted",
+	CodeOutOfRange:         "out of range",
+	CodeUnimplemented:      "unimplemented",
+	CodeInternal:           "internal",
+	CodeUnavailable:        "unavailable",
+	CodeDataLoss:           "data loss",
+	CodeUnauthenticated:    "unauthenticated",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("code %d", int32(c))
+}
+
+func (c Code) Error() string {
+	return c.String()
+}
+
+//
+// A Code returned as an error is sent as itself.
+//
+func (c Code) ErrorCode() Code {
+	return c
+}
+
+//
+// Errors returned by a RequestHandler that implement Coder are sent
+// with their code (and details, if they also implement Detailer).
+//
+type Coder interface {
+	ErrorCode() Code
+}
+
+type Detailer interface {
+	ErrorDetails() interface{}
+}
+
+//
+// RemoteError is the error a Future fails with when the peer answers
+// with an error.  Details holds an optional encoded payload; use
+// DecodeDetails to read it.  Method is the method that was called,
+// and Stack is the remote stack trace, if the peer sent one.
+//
+type RemoteError struct {
+	Code    Code
+	Message string
+	Details []byte
+	Method  string
+	Stack   string
+}
+
+//
+// Create a RemoteError to return from a RequestHandler or a
+// registered method.
+//
+func Errorf(code Code, format string, args ...interface{}) *RemoteError {
+	return &RemoteError{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+func (e *RemoteError) ErrorCode() Code {
+	return e.Code
+}
+
+//
+// Matches a Code equal to e.Code, or a *RemoteError with the same
+// Code and, if set, the same Message.
+//
+func (e *RemoteError) Is(target error) bool {
+	switch t := target.(type) {
+	case Code:
+		return e.Code == t
+	case *RemoteError:
+		return e.Code == t.Code && (t.Message == "" || t.Message == e.Message)
+	}
+	return false
+}
+
+//
+// Attach details, encoded like any other payload.
+//
+func (e *RemoteError) WithDetails(v interface{}) *RemoteError {
+	buf := bytes.Buffer{}
+	enc := codec.NewEncoder(&buf, &mph)
+	enc.Encode(v)
+	enc.Release()
+	e.Details = buf.Bytes()
+	return e
+}
+
+func (e *RemoteError) DecodeDetails(v interface{}) error {
+	if len(e.Details) == 0 {
+		return fmt.Errorf("no error details")
+	}
+	dec := codec.NewDecoder(bytes.NewBuffer(e.Details), &mph)
+	return dec.Decode(v)
+}
+
+//
+// The Code of err: its own if it is (or wraps) a Coder, one derived
+// from context errors, or CodeUnknown.
+//
+func ErrorCode(err error) Code {
+	var coder Coder
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &coder):
+		return coder.ErrorCode()
+	case errors.Is(err, context.Canceled):
+		return CodeCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeDeadlineExceeded
+	}
+	return CodeUnknown
+}
+
+//
+// Convert any error to the RemoteError sent on the wire.
+//
+func toRemoteError(err error) *RemoteError {
+	var re *RemoteError
+	if errors.As(err, &re) {
+		return re
+	}
+
+	re = &RemoteError{
+		Code:    ErrorCode(err),
+		Message: err.Error(),
+	}
+
+	var detailer Detailer
+	if errors.As(err, &detailer) {
+		re.WithDetails(detailer.ErrorDetails())
+	}
+
+	return re
+}
@@ -0,0 +1,169 @@
+package armie
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var eventType = reflect.TypeOf((*Event)(nil))
+
+//
+// An EventMux routes events to handlers registered by event name, for
+// use as a Conn's EventHandler:
+//
+//	mux := armie.NewEventMux()
+//	mux.On("user.created", func(u *User) { ... })
+//	conn.OnEvent(mux.HandleEvent)
+//
+// Names are matched as topic patterns (see MatchTopic), so "user.*"
+// and "user.>" route every event under "user.".  Every handler whose
+// pattern matches is called, in the order they were registered;
+// events no handler matches are dropped.
+//
+// The zero EventMux is ready to use.
+//
+type EventMux struct {
+	mu      sync.RWMutex
+	entries []*muxEntry
+	// Called with decoding errors and errors returned by handlers.
+	// If nil they are dropped.
+	ErrorHandler func(evt *Event, err error)
+}
+
+type muxEntry struct {
+	pattern string
+	fn      reflect.Value
+	// the *Event and payload arguments, if the handler takes them
+	event   bool
+	payload reflect.Type
+}
+
+//
+// Returned by EventMux.On to remove the handler again.
+//
+type EventRegistration struct {
+	mux   *EventMux
+	entry *muxEntry
+}
+
+func NewEventMux() *EventMux {
+	return &EventMux{}
+}
+
+//
+// Call handler for events whose name matches pattern.  handler is a
+// func taking the payload, decoded into the parameter's type as in
+// Request.CallMethod, the *Event, or the *Event followed by the
+// payload:
+//
+//	func(u *User)
+//	func(evt *armie.Event)
+//	func(evt *armie.Event, u User) error
+//
+// It may return an error, which is passed to the ErrorHandler.
+//
+func (m *EventMux) On(pattern string, handler interface{}) (*EventRegistration, error) {
+	if err := ValidTopicPattern(pattern); err != nil {
+		return nil, err
+	}
+	entry, err := newMuxEntry(pattern, handler)
+	if err != nil {
+		return nil, fmt.Errorf("cannot handle %s: %v", pattern, err)
+	}
+
+	m.mu.Lock()
+	m.entries = append(m.entries, entry)
+	m.mu.Unlock()
+	return &EventRegistration{m, entry}, nil
+}
+
+func newMuxEntry(pattern string, handler interface{}) (*muxEntry, error) {
+	t := reflect.TypeOf(handler)
+	if t == nil || t.Kind() != reflect.Func {
+		return nil, fmt.Errorf("%v is not a func", t)
+	}
+	switch {
+	case t.NumOut() > 1, t.NumOut() == 1 && t.Out(0) != errorType:
+		return nil, fmt.Errorf("handler may only return an error")
+	case t.IsVariadic():
+		return nil, fmt.Errorf("variadic funcs are not supported")
+	}
+
+	entry := &muxEntry{
+		pattern: pattern,
+		fn:      reflect.ValueOf(handler),
+	}
+	in := make([]reflect.Type, t.NumIn())
+	for i := range in {
+		in[i] = t.In(i)
+	}
+	if len(in) > 0 && in[0] == eventType {
+		entry.event = true
+		in = in[1:]
+	}
+	switch len(in) {
+	case 0:
+	case 1:
+		entry.payload = in[0]
+	default:
+		return nil, fmt.Errorf("handler takes %d arguments, want the event and at most one payload", t.NumIn())
+	}
+	return entry, nil
+}
+
+//
+// Stop calling the handler.  Events already being handled are
+// unaffected.
+//
+func (r *EventRegistration) Off() {
+	m := r.mux
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, e := range m.entries {
+		if e == r.entry {
+			m.entries = append(m.entries[:i:i], m.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+//
+// Route evt to every matching handler.  An EventHandler.
+//
+func (m *EventMux) HandleEvent(evt *Event) {
+	m.mu.RLock()
+	entries := m.entries
+	m.mu.RUnlock()
+
+	for _, e := range entries {
+		if !MatchTopic(e.pattern, evt.Event) {
+			continue
+		}
+		if err := e.call(evt); err != nil && m.ErrorHandler != nil {
+			m.ErrorHandler(evt, err)
+		}
+	}
+}
+
+func (e *muxEntry) call(evt *Event) error {
+	args := make([]reflect.Value, 0, 2)
+	if e.event {
+		args = append(args, reflect.ValueOf(evt))
+	}
+	if e.payload != nil {
+		v := reflect.New(e.payload)
+		if len(evt.Payload) > 0 {
+			if err := evt.Decode(v.Interface()); err != nil {
+				return fmt.Errorf("decoding %s event as %v: %v", evt.Event, e.payload, err)
+			}
+		}
+		args = append(args, v.Elem())
+	}
+
+	results := e.fn.Call(args)
+	if len(results) > 0 && !results[0].IsNil() {
+		return results[0].Interface().(error)
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package armie
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//
+// Credit-based flow control for events and stream messages.  Each
+// side grants its peer a connection window, shared by all events and
+// stream messages, and a window per stream, both in payload bytes,
+// and announces them in the handshake.  A sender spends credit as it
+// sends and waits while either window is exhausted; a receiver
+// returns credit with window updates as its handlers and Recv calls
+// consume what was sent.  A slow consumer thereby throttles the
+// sender instead of queueing without bound.  Requests and responses
+// are not flow controlled.
+//
+// Flow control is used only if both peers announce windows; set
+// Options.ConnWindow or Options.StreamWindow negative to disable it.
+//
+const (
+	defaultConnWindow   = 1 << 20
+	defaultStreamWindow = 256 << 10
+)
+
+//
+// Returned, wrapped, by sends that were asked not to wait when the
+// peer's window is full.
+//
+var errWindowFull = errors.New("flow control window full")
+
+//
+// Marks a context whose sends fail with errWindowFull rather than
+// wait for credit.
+//
+type noWaitKey struct{}
+
+//
+// Flow control statistics for a Conn.
+//
+type FlowStats struct {
+	// Sends that had to wait for credit, and the total time spent
+	// waiting.
+	Blocked     int64
+	BlockedTime time.Duration
+	// Connection credit currently available for sending.
+	SendWindow int64
+}
+
+type flowControl struct {
+	mu sync.Mutex
+	// credit granted by the peer
+	connSend     int64
+	streamWindow int64
+	streamSend   map[uint64]int64
+	changed      chan struct{}
+	// credit we granted, and what has been consumed since it was
+	// last returned
+	connWindow    int64
+	recvWindow    int64
+	connUnacked   int64
+	streamUnacked map[uint64]int64
+	stats         FlowStats
+}
+
+func windowSize(size, def int) int64 {
+	if size == 0 {
+		return int64(def)
+	}
+	if size < 0 {
+		return 0
+	}
+	return int64(size)
+}
+
+//
+// Enable flow control once the peer's windows are known, if both
+// sides announced them.
+//
+func (c *Conn) startFlowControl() {
+	local := localPeerInfo(&c.opts)
+	if local.ConnWindow <= 0 || local.StreamWindow <= 0 || c.peer.ConnWindow <= 0 || c.peer.StreamWindow <= 0 {
+		return
+	}
+	c.flow = &flowControl{
+		connSend:      c.peer.ConnWindow,
+		streamWindow:  c.peer.StreamWindow,
+		streamSend:    make(map[uint64]int64),
+		changed:       make(chan struct{}),
+		connWindow:    local.ConnWindow,
+		recvWindow:    local.StreamWindow,
+		streamUnacked: make(map[uint64]int64),
+	}
+	c.dispatch.serialize()
+}
+
+//
+// Flow control statistics.  Zero if flow control is not in use.
+//
+func (c *Conn) FlowStats() FlowStats {
+	fc := c.flow
+	if fc == nil {
+		return FlowStats{}
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	stats := fc.stats
+	stats.SendWindow = fc.connSend
+	return stats
+}
+
+//
+// Wait for credit to send n bytes on stream id, or as an event if id
+// is 0.  Credit may run negative by one message, so messages larger
+// than a window still get through.  Gives up when ctx or done is
+// done, or the connection starts closing.
+//
+func (c *Conn) acquireCredit(ctx context.Context, done <-chan struct{}, id uint64, n int) error {
+	fc := c.flow
+	if fc == nil {
+		return nil
+	}
+
+	var start time.Time
+	for {
+		fc.mu.Lock()
+		stream, ok := fc.streamSend[id]
+		if !ok {
+			stream = fc.streamWindow
+		}
+		if fc.connSend > 0 && (id == 0 || stream > 0) {
+			fc.connSend -= int64(n)
+			if id != 0 {
+				fc.streamSend[id] = stream - int64(n)
+			}
+			if !start.IsZero() {
+				fc.stats.BlockedTime += time.Since(start)
+			}
+			fc.mu.Unlock()
+			return nil
+		}
+		if ctx.Value(noWaitKey{}) != nil {
+			fc.mu.Unlock()
+			return fmt.Errorf("sending to %s: %w", c.addr, errWindowFull)
+		}
+		if start.IsZero() {
+			start = time.Now()
+			fc.stats.Blocked++
+		}
+		changed := fc.changed
+		fc.mu.Unlock()
+
+		var err error
+		select {
+		case <-changed:
+			continue
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-done:
+			err = ErrStreamClosed
+		case <-c.stopping:
+			err = ErrConnectionClosed
+		}
+
+		fc.mu.Lock()
+		fc.stats.BlockedTime += time.Since(start)
+		fc.mu.Unlock()
+		return fmt.Errorf("waiting for flow control credit: %w", err)
+	}
+}
+
+//
+// Apply a window update from the peer.
+//
+func (c *Conn) handleWindow(frm *frame) {
+	fc := c.flow
+	if fc == nil {
+		return
+	}
+	fc.mu.Lock()
+	if frm.Id == 0 {
+		fc.connSend += frm.Window
+	} else if stream, ok := fc.streamSend[frm.Id]; ok {
+		fc.streamSend[frm.Id] = stream + frm.Window
+	}
+	close(fc.changed)
+	fc.changed = make(chan struct{})
+	fc.mu.Unlock()
+}
+
+//
+// Note that n bytes received on stream id, or as an event if id is 0,
+// have been consumed, returning credit to the peer once half a window
+// has been consumed.
+//
+func (c *Conn) consumed(id uint64, n int) {
+	fc := c.flow
+	if fc == nil || n == 0 {
+		return
+	}
+
+	var connUpdate, streamUpdate int64
+	fc.mu.Lock()
+	fc.connUnacked += int64(n)
+	if fc.connUnacked >= fc.connWindow/2 {
+		connUpdate = fc.connUnacked
+		fc.connUnacked = 0
+	}
+	if id != 0 {
+		unacked := fc.streamUnacked[id] + int64(n)
+		if unacked >= fc.recvWindow/2 {
+			streamUpdate = unacked
+			unacked = 0
+		}
+		fc.streamUnacked[id] = unacked
+	}
+	fc.mu.Unlock()
+
+	if connUpdate > 0 {
+		c.sendWindow(0, connUpdate)
+	}
+	if streamUpdate > 0 {
+		c.sendWindow(id, streamUpdate)
+	}
+}
+
+func (c *Conn) sendWindow(id uint64, credit int64) {
+	if err := encodeWindow(c, id, credit); err != nil {
+		c.logger.Trace("[RPC] sending window update to %v: %v", c.addr, err)
+	}
+}
+
+//
+// Forget the windows of a finished stream.
+//
+func (c *Conn) forgetStream(id uint64) {
+	fc := c.flow
+	if fc == nil {
+		return
+	}
+	fc.mu.Lock()
+	delete(fc.streamSend, id)
+	delete(fc.streamUnacked, id)
+	fc.mu.Unlock()
+}
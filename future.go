@@ -1,40 +1,108 @@
 package armie
 
-import "sync"
+import (
+	"context"
+	"sync"
+)
 
 //
 //  RPC future for awaiting responses to RMI requests
 //
 type Future struct {
-	wg  sync.WaitGroup
-	res *frame
-	err error
+	done   chan struct{}
+	once   sync.Once
+	res    *frame
+	err    error
+	conn   *Conn
+	id     uint64
+	method string
+	// abandons the Stream behind the Future, if it stands for one
+	abandon func(err error)
 }
 
-func newFuture() *Future {
-	f := &Future{}
-	f.wg.Add(1)
+func newFuture(conn *Conn, id uint64, method string) *Future {
+	return &Future{
+		done:   make(chan struct{}),
+		conn:   conn,
+		id:     id,
+		method: method,
+	}
+}
 
-	return f
+//
+// Settle the Future with the response frame, which may carry an
+// error, and/or err.
+//
+func (f *Future) finish(res *frame, err error) {
+	f.once.Do(func() {
+		f.res = res
+		f.err = err
+		close(f.done)
+	})
 }
 
+func (f *Future) requestMethod() string {
+	return f.method
+}
 
-func (f *Future) complete(res *frame) {
-	f.res = res
-	f.wg.Done()
+//
+// The trailer the peer sent with its response, once the Future has
+// completed.  Nil if there is none, or if the Future has not yet
+// completed or failed without a response.
+//
+func (f *Future) Trailer() Metadata {
+	select {
+	case <-f.done:
+	default:
+		return nil
+	}
+	if f.res == nil {
+		return nil
+	}
+	return f.res.Meta
 }
 
-func (f *Future) error(err error) {
-	f.err = err
-	f.wg.Done()
+//
+// Abandon the request: forget the outstanding entry, tell the peer
+// to cancel, and fail the Future with err.  If the response has
+// already been routed, the Future completes normally instead.
+//
+func (f *Future) cancel(err error) {
+	if f.abandon != nil {
+		f.abandon(err)
+		return
+	}
+	if f.conn.cancelRequest(f.id) {
+		f.finish(nil, err)
+	}
 }
 
 //
 // Await the response or error.  If the error returned is not-nil,
-// the result will be nil.
+// the result will be nil.  An error sent by the peer is returned as
+// a *RemoteError.
 //
 func (f *Future) GetResult(res interface{}) error {
-	f.wg.Wait()
+	<-f.done
+	return f.result(res)
+}
+
+//
+// Await the response or error, giving up when ctx is done.  On
+// cancellation or deadline the request is abandoned, the peer is
+// sent a cancel, and ctx.Err() is returned.
+//
+func (f *Future) GetResultContext(ctx context.Context, res interface{}) error {
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		f.cancel(ctx.Err())
+		<-f.done
+	}
+	return f.result(res)
+}
+
+func (f *Future) result(res interface{}) error {
 	if f.err != nil {
 		return f.err
 	}
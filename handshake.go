@@ -0,0 +1,200 @@
+package armie
+
+import (
+	"fmt"
+	"time"
+)
+
+//
+// The protocol version spoken by this package, and the oldest one it
+// accepts from a peer.  Peers exchange a hello frame carrying their
+// PeerInfo before any other frame; a Server refuses clients that send
+// anything else first, or whose version or codecs it cannot speak.
+//
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+const defaultHandshakeTimeout = 10 * time.Second
+
+var (
+	supportedCodecs      = []string{"msgpack"}
+	supportedCompression = []string{}
+)
+
+//
+// What a peer announced about itself in the handshake.
+//
+type PeerInfo struct {
+	Version      int      `codec:"v"`
+	Codecs       []string `codec:"c"`
+	Compression  []string `codec:"z,omitempty"`
+	Name         string   `codec:"n,omitempty"`
+	Capabilities []string `codec:"f,omitempty"`
+	// Flow control windows granted to the peer, in bytes; zero if
+	// flow control is not supported or disabled.
+	ConnWindow   int64 `codec:"cw,omitempty"`
+	StreamWindow int64 `codec:"sw,omitempty"`
+}
+
+func (p *PeerInfo) HasCapability(name string) bool {
+	for _, c := range p.Capabilities {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+func localPeerInfo(opts *Options) *PeerInfo {
+	return &PeerInfo{
+		Version:      ProtocolVersion,
+		Codecs:       supportedCodecs,
+		Compression:  supportedCompression,
+		Name:         opts.Name,
+		Capabilities: opts.Capabilities,
+		ConnWindow:   windowSize(opts.ConnWindow, defaultConnWindow),
+		StreamWindow: windowSize(opts.StreamWindow, defaultStreamWindow),
+	}
+}
+
+//
+// Check that we can speak to a peer announcing info.  Newer peers are
+// expected to fall back to our version.
+//
+func checkPeer(info *PeerInfo) *RemoteError {
+	if info.Version < MinProtocolVersion {
+		return Errorf(CodeFailedPrecondition, "unsupported protocol version %d (need %d to %d)",
+			info.Version, MinProtocolVersion, ProtocolVersion)
+	}
+	for _, c := range info.Codecs {
+		for _, s := range supportedCodecs {
+			if c == s {
+				return nil
+			}
+		}
+	}
+	return Errorf(CodeFailedPrecondition, "no common codec: peer offers %v, we support %v",
+		info.Codecs, supportedCodecs)
+}
+
+//
+// What the peer announced in the handshake.
+//
+func (c *Conn) PeerInfo() *PeerInfo {
+	return c.peer
+}
+
+func (c *Conn) handshakeTimeout() time.Duration {
+	if c.opts.HandshakeTimeout > 0 {
+		return c.opts.HandshakeTimeout
+	}
+	return defaultHandshakeTimeout
+}
+
+//
+// Read the peer's first frame, closing the connection if it does not
+// arrive in time.
+//
+func (c *Conn) readHello() (*frame, error) {
+	timeout := c.handshakeTimeout()
+	timer := time.AfterFunc(timeout, func() {
+		c.conn.Close()
+	})
+	frm, err := readFrame(c)
+	if !timer.Stop() {
+		return nil, fmt.Errorf("no hello within %v", timeout)
+	}
+	return frm, err
+}
+
+//
+// The dialing side of the handshake: say hello, answer any auth
+// challenges, and wait for the peer's hello or its reason for
+// refusing us.
+//
+func (c *Conn) handshake() error {
+	if err := encodeHello(c, localPeerInfo(&c.opts), nil); err != nil {
+		return fmt.Errorf("handshake with %s: %w", c.addr, err)
+	}
+
+	frm, err := c.readHello()
+	for err == nil && frm.Type == AUTH {
+		if err = c.respondAuth(frm); err == nil {
+			frm, err = c.readHello()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("handshake with %s: %w", c.addr, err)
+	}
+	if frm.Type != HELLO {
+		return fmt.Errorf("handshake with %s: expected hello, got frame type %d", c.addr, frm.Type)
+	}
+	if frm.Error != "" || frm.Code != 0 {
+		code := Code(frm.Code)
+		if code == 0 {
+			code = CodeUnknown
+		}
+		return fmt.Errorf("handshake with %s refused: %w", c.addr, &RemoteError{
+			Code:    code,
+			Message: frm.Error,
+			Details: frm.Details,
+		})
+	}
+
+	info, err := decodeHello(frm)
+	if err != nil {
+		return fmt.Errorf("handshake with %s: malformed hello: %w", c.addr, err)
+	}
+	if rerr := checkPeer(info); rerr != nil {
+		return fmt.Errorf("handshake with %s: %w", c.addr, rerr)
+	}
+
+	c.peer = info
+	c.startFlowControl()
+	return nil
+}
+
+//
+// The accepting side of the handshake: wait for the peer's hello,
+// authenticate the peer if there is an Authenticator, and answer with
+// our hello, or with the reason it is refused.  A peer that
+// predates the handshake and opens with a request is refused with an
+// error response to that request, which it understands.
+//
+func (c *Conn) acceptHandshake() error {
+	frm, err := c.readHello()
+	if err != nil {
+		return err
+	}
+
+	var info *PeerInfo
+	var rerr *RemoteError
+	if frm.Type != HELLO {
+		rerr = Errorf(CodeFailedPrecondition, "no handshake from peer; protocol version %d or later is required",
+			MinProtocolVersion)
+	} else if info, err = decodeHello(frm); err != nil {
+		rerr = Errorf(CodeInvalidArgument, "malformed hello: %v", err)
+	} else if rerr = checkPeer(info); rerr == nil && c.opts.Authenticator != nil {
+		id, err := c.authenticate(c.opts.Authenticator)
+		if err != nil {
+			c.logger.Warn("[RPC] authentication of %v failed: %v", c.addr, err)
+			rerr = Errorf(CodeUnauthenticated, "authentication failed")
+		}
+		c.identity = id
+	}
+
+	if rerr != nil {
+		if frm.Type == REQUEST {
+			encodeResponse(c, &Response{Id: frm.Id, ErrString: rerr.Message, err: rerr})
+		} else {
+			encodeHello(c, nil, rerr)
+		}
+		return rerr
+	}
+
+	c.peer = info
+	c.startFlowControl()
+	return encodeHello(c, localPeerInfo(&c.opts), nil)
+}
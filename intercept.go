@@ -0,0 +1,217 @@
+package armie
+
+import (
+	"context"
+	"sync"
+)
+
+//
+// Interceptors wrap request and event handling, and the sending of
+// requests and events, with cross-cutting logic such as logging,
+// metrics or authorization.  Each receives the next step in the chain
+// and decides whether, and how, to call it.
+//
+// Interceptors added to a Server (through Options or its Use methods)
+// apply to every Conn it accepts, including those already accepted,
+// and run outside those added to the Conn itself.  Within each, the
+// first added is the outermost.  For a Server with interceptors S1, S2
+// and a Conn with C1, an inbound request runs
+//
+//	S1 -> S2 -> C1 -> handler
+//
+// where handler is the registered method or RequestHandler, or the
+// "unknown method" error if there is neither.
+//
+
+//
+// Wraps an inbound request.  A RequestInterceptor may answer the
+// request itself, with res.SendError for instance, instead of calling
+// next.
+//
+type RequestInterceptor func(req *Request, res *Response, next RequestHandler)
+
+//
+// Wraps an inbound event.  An EventInterceptor may drop the event by
+// not calling next.
+//
+type EventInterceptor func(evt *Event, next EventHandler)
+
+//
+// Sends an outbound request; the final step is Conn.SendRequestContext
+// itself.
+//
+type SendRequestFunc func(ctx context.Context, method string, args []interface{}) (*Future, error)
+
+//
+// Wraps an outbound request.  The returned Future, or error, is what
+// SendRequest and SendRequestContext return.  Client interceptors also
+// wrap the opening of streams; see OpenStream.
+//
+type ClientInterceptor func(ctx context.Context, method string, args []interface{}, next SendRequestFunc) (*Future, error)
+
+//
+// Sends an outbound event; the final step is Conn.SendEventContext
+// itself.
+//
+type SendEventFunc func(ctx context.Context, event string, data interface{}) error
+
+//
+// Wraps an outbound event.
+//
+type ClientEventInterceptor func(ctx context.Context, event string, data interface{}, next SendEventFunc) error
+
+type interceptors struct {
+	mu          sync.RWMutex
+	request     []RequestInterceptor
+	event       []EventInterceptor
+	client      []ClientInterceptor
+	clientEvent []ClientEventInterceptor
+}
+
+func newInterceptors(opts *Options) *interceptors {
+	ic := &interceptors{}
+	if opts != nil {
+		ic.request = append(ic.request, opts.RequestInterceptors...)
+		ic.event = append(ic.event, opts.EventInterceptors...)
+		ic.client = append(ic.client, opts.ClientInterceptors...)
+		ic.clientEvent = append(ic.clientEvent, opts.ClientEventInterceptors...)
+	}
+	return ic
+}
+
+//
+// Snapshot the interceptors of server (which may be nil) followed by
+// those of conn.
+//
+func collect[T any](server, conn *interceptors, field func(*interceptors) []T) []T {
+	var all []T
+	for _, ic := range []*interceptors{server, conn} {
+		if ic == nil {
+			continue
+		}
+		ic.mu.RLock()
+		all = append(all, field(ic)...)
+		ic.mu.RUnlock()
+	}
+	return all
+}
+
+func (c *Conn) chainRequest(handler RequestHandler) RequestHandler {
+	chain := collect(c.serverInterceptors, c.interceptors, func(ic *interceptors) []RequestInterceptor { return ic.request })
+	for i := len(chain) - 1; i >= 0; i-- {
+		ic, next := chain[i], handler
+		handler = func(req *Request, res *Response) {
+			ic(req, res, next)
+		}
+	}
+	return handler
+}
+
+func (c *Conn) chainEvent(handler EventHandler) EventHandler {
+	chain := collect(c.serverInterceptors, c.interceptors, func(ic *interceptors) []EventInterceptor { return ic.event })
+	for i := len(chain) - 1; i >= 0; i-- {
+		ic, next := chain[i], handler
+		handler = func(evt *Event) {
+			ic(evt, next)
+		}
+	}
+	return handler
+}
+
+func (c *Conn) chainClient(send SendRequestFunc) SendRequestFunc {
+	chain := collect(c.serverInterceptors, c.interceptors, func(ic *interceptors) []ClientInterceptor { return ic.client })
+	for i := len(chain) - 1; i >= 0; i-- {
+		ic, next := chain[i], send
+		send = func(ctx context.Context, method string, args []interface{}) (*Future, error) {
+			return ic(ctx, method, args, next)
+		}
+	}
+	return send
+}
+
+func (c *Conn) chainClientEvent(send SendEventFunc) SendEventFunc {
+	chain := collect(c.serverInterceptors, c.interceptors, func(ic *interceptors) []ClientEventInterceptor { return ic.clientEvent })
+	for i := len(chain) - 1; i >= 0; i-- {
+		ic, next := chain[i], send
+		send = func(ctx context.Context, event string, data interface{}) error {
+			return ic(ctx, event, data, next)
+		}
+	}
+	return send
+}
+
+//
+// Add interceptors run around every inbound request on this Conn.
+//
+func (c *Conn) UseRequest(ics ...RequestInterceptor) {
+	c.interceptors.mu.Lock()
+	defer c.interceptors.mu.Unlock()
+	c.interceptors.request = append(c.interceptors.request, ics...)
+}
+
+//
+// Add interceptors run around every inbound event on this Conn.
+//
+func (c *Conn) UseEvent(ics ...EventInterceptor) {
+	c.interceptors.mu.Lock()
+	defer c.interceptors.mu.Unlock()
+	c.interceptors.event = append(c.interceptors.event, ics...)
+}
+
+//
+// Add interceptors run around every request sent on this Conn.
+//
+func (c *Conn) UseClient(ics ...ClientInterceptor) {
+	c.interceptors.mu.Lock()
+	defer c.interceptors.mu.Unlock()
+	c.interceptors.client = append(c.interceptors.client, ics...)
+}
+
+//
+// Add interceptors run around every event sent on this Conn.
+//
+func (c *Conn) UseClientEvent(ics ...ClientEventInterceptor) {
+	c.interceptors.mu.Lock()
+	defer c.interceptors.mu.Unlock()
+	c.interceptors.clientEvent = append(c.interceptors.clientEvent, ics...)
+}
+
+//
+// Add interceptors run around every inbound request on every Conn
+// the Server accepts.  See Conn.UseRequest.
+//
+func (serv *Server) UseRequest(ics ...RequestInterceptor) {
+	serv.interceptors.mu.Lock()
+	defer serv.interceptors.mu.Unlock()
+	serv.interceptors.request = append(serv.interceptors.request, ics...)
+}
+
+//
+// Add interceptors run around every inbound event on every Conn the
+// Server accepts.
+//
+func (serv *Server) UseEvent(ics ...EventInterceptor) {
+	serv.interceptors.mu.Lock()
+	defer serv.interceptors.mu.Unlock()
+	serv.interceptors.event = append(serv.interceptors.event, ics...)
+}
+
+//
+// Add interceptors run around every request sent to a client on a
+// Conn the Server accepted.
+//
+func (serv *Server) UseClient(ics ...ClientInterceptor) {
+	serv.interceptors.mu.Lock()
+	defer serv.interceptors.mu.Unlock()
+	serv.interceptors.client = append(serv.interceptors.client, ics...)
+}
+
+//
+// Add interceptors run around every event sent to a client on a Conn
+// the Server accepted.
+//
+func (serv *Server) UseClientEvent(ics ...ClientEventInterceptor) {
+	serv.interceptors.mu.Lock()
+	defer serv.interceptors.mu.Unlock()
+	serv.interceptors.clientEvent = append(serv.interceptors.clientEvent, ics...)
+}
@@ -0,0 +1,89 @@
+package armie
+
+import (
+	"context"
+)
+
+//
+// Metadata is a set of string key-value pairs sent alongside a
+// request, event or response: auth tokens, tenant or trace IDs and
+// the like.  Keys are case-sensitive.  Peers that predate metadata
+// ignore it, and frames from them simply carry none.
+//
+type Metadata map[string]string
+
+//
+// The value for key, or "" if it is not set.  Safe on a nil Metadata.
+//
+func (md Metadata) Get(key string) string {
+	return md[key]
+}
+
+//
+// A copy of md with the entries of each of others added, later ones
+// taking precedence.  Returns nil if the result is empty.
+//
+func (md Metadata) Merge(others ...Metadata) Metadata {
+	var out Metadata
+	for _, m := range append([]Metadata{md}, others...) {
+		for k, v := range m {
+			if out == nil {
+				out = make(Metadata)
+			}
+			out[k] = v
+		}
+	}
+	return out
+}
+
+type outgoingKey struct{}
+type incomingKey struct{}
+
+//
+// Attach md to ctx, to be sent with requests and events made with
+// SendRequestContext and SendEventContext.  Metadata already attached
+// to ctx is kept, with md taking precedence.
+//
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, OutgoingMetadata(ctx).Merge(md))
+}
+
+//
+// The metadata attached to ctx with WithMetadata.
+//
+func OutgoingMetadata(ctx context.Context) Metadata {
+	md, _ := ctx.Value(outgoingKey{}).(Metadata)
+	return md
+}
+
+//
+// The metadata the caller sent with a request, given its
+// Request.Context().  Incoming metadata is not forwarded on requests
+// made with that context; use WithMetadata to pass it on.
+//
+func IncomingMetadata(ctx context.Context) Metadata {
+	md, _ := ctx.Value(incomingKey{}).(Metadata)
+	return md
+}
+
+//
+// Set metadata sent with every request and event on this Conn, such
+// as an auth token.  Metadata attached with WithMetadata takes
+// precedence over it.
+//
+func (c *Conn) SetMetadata(md Metadata) {
+	md = md.Merge()
+	c.mu.Lock()
+	c.metadata = md
+	c.mu.Unlock()
+}
+
+//
+// The Conn's own metadata merged with that attached to ctx.
+//
+func (c *Conn) outgoingMetadata(ctx context.Context) Metadata {
+	c.mu.Lock()
+	md := c.metadata
+	c.mu.Unlock()
+	return md.Merge(OutgoingMetadata(ctx))
+}
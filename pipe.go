@@ -0,0 +1,128 @@
+package armie
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+//
+// The in-process pipe transport connects a Conn to a Server in the
+// same process without touching the network stack.  Servers Listen
+// on an arbitrary name, and connections Dial that name.  Each
+// connection is a net.Pipe, which is unbuffered: a write blocks until
+// the peer's reader consumes it.
+//
+type pipeTransport struct{}
+
+var pipeListeners = struct {
+	sync.Mutex
+	byName map[string]*pipeListener
+}{byName: make(map[string]*pipeListener)}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+type pipeListener struct {
+	name   string
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	err := net.ErrClosed
+	l.once.Do(func() {
+		pipeListeners.Lock()
+		delete(pipeListeners.byName, l.name)
+		pipeListeners.Unlock()
+		close(l.closed)
+		err = nil
+	})
+	return err
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr(l.name)
+}
+
+func (pipeTransport) Dial(address string) (*TransportConn, error) {
+	pipeListeners.Lock()
+	l := pipeListeners.byName[address]
+	pipeListeners.Unlock()
+
+	if l == nil {
+		return nil, fmt.Errorf("no pipe listener named %q", address)
+	}
+
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+	case <-l.closed:
+		client.Close()
+		server.Close()
+		return nil, fmt.Errorf("pipe listener %q closed", address)
+	}
+
+	return &TransportConn{
+		Socket:  client,
+		Address: address,
+	}, nil
+}
+
+func (pipeTransport) Listen(address string) (net.Listener, error) {
+	pipeListeners.Lock()
+	defer pipeListeners.Unlock()
+
+	if _, ok := pipeListeners.byName[address]; ok {
+		return nil, fmt.Errorf("pipe name %q already in use", address)
+	}
+
+	l := &pipeListener{
+		name:   address,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	pipeListeners.byName[address] = l
+
+	return l, nil
+}
+
+//
+// The in-process pipe Transport.  Addresses are arbitrary names.
+//
+func PipeTransport() Transport {
+	return &pipeTransport{}
+}
+
+//
+// Create a Server that accepts in-process pipe connections.  The
+// address passed to Listen is any name unique within the process.
+//
+func NewPipeServer(logout io.Writer) *Server {
+	return NewServer(PipeTransport(), &Options{Logger: logout})
+}
+
+//
+// Connect to an in-process pipe Server listening on name.
+//
+func NewPipeConnection(name string, logout io.Writer, handler ConnectionHandler) (*Conn, error) {
+	return Dial(PipeTransport(), name, &Options{Logger: logout, ConnectionHandler: handler})
+}
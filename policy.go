@@ -0,0 +1,123 @@
+package armie
+
+import (
+	"fmt"
+	"path"
+)
+
+//
+// A Policy decides which requests and events each peer may send,
+// based on the Identity established by the Authenticator.  It is
+// checked on every inbound request and event before it is dispatched;
+// denied requests are answered with a CodePermissionDenied error,
+// denied events are dropped, and both are logged.
+//
+// Deny rules take precedence over Allow rules.  A request or event
+// that matches neither is allowed only if DefaultAllow is set.
+//
+type Policy struct {
+	Allow        []Rule
+	Deny         []Rule
+	DefaultAllow bool
+}
+
+//
+// A Rule matches a request or event when each of its non-empty fields
+// matches.  Identities, Methods and Events hold glob patterns as in
+// path.Match ("Greeter.*", "admin-?"); Roles match any of the peer's
+// roles exactly.  A Rule with no Methods does not apply to requests,
+// and one with no Events does not apply to events; use "*" to match
+// every name.  Unauthenticated peers match only Rules without
+// Identities or Roles.
+//
+type Rule struct {
+	Identities []string
+	Roles      []string
+	Methods    []string
+	Events     []string
+}
+
+//
+// Check every pattern in the Policy.  A malformed pattern never
+// matches in an Allow rule and always matches in a Deny rule.
+//
+func (p *Policy) Validate() error {
+	for _, rules := range [][]Rule{p.Allow, p.Deny} {
+		for _, r := range rules {
+			for _, patterns := range [][]string{r.Identities, r.Methods, r.Events} {
+				for _, pattern := range patterns {
+					if _, err := path.Match(pattern, ""); err != nil {
+						return fmt.Errorf("bad pattern %q in policy: %v", pattern, err)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+//
+// Whether the peer id may call method.
+//
+func (p *Policy) AllowRequest(id *Identity, method string) bool {
+	return p.allowed(id, method, func(r *Rule) []string { return r.Methods })
+}
+
+//
+// Whether the peer id may send event.
+//
+func (p *Policy) AllowEvent(id *Identity, event string) bool {
+	return p.allowed(id, event, func(r *Rule) []string { return r.Events })
+}
+
+func (p *Policy) allowed(id *Identity, name string, names func(*Rule) []string) bool {
+	for i := range p.Deny {
+		if p.Deny[i].matches(id, name, names(&p.Deny[i]), true) {
+			return false
+		}
+	}
+	for i := range p.Allow {
+		if p.Allow[i].matches(id, name, names(&p.Allow[i]), false) {
+			return true
+		}
+	}
+	return p.DefaultAllow
+}
+
+func (r *Rule) matches(id *Identity, name string, names []string, onError bool) bool {
+	if len(names) == 0 || !matchAny(names, name, onError) {
+		return false
+	}
+	if len(r.Identities) > 0 && (id == nil || !matchAny(r.Identities, id.Name, onError)) {
+		return false
+	}
+	if len(r.Roles) > 0 {
+		for _, role := range r.Roles {
+			if id.HasRole(role) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchAny(patterns []string, name string, onError bool) bool {
+	for _, pattern := range patterns {
+		ok, err := path.Match(pattern, name)
+		if err != nil {
+			ok = onError
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func identityName(id *Identity) string {
+	if id == nil {
+		return "unauthenticated peer"
+	}
+	return id.Name
+}
@@ -0,0 +1,210 @@
+package armie
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+//
+// Topic-based publish/subscribe on top of events.  A client calls
+// Conn.Subscribe with a topic pattern; the Server remembers the
+// patterns of each Conn until it unsubscribes or disconnects, and
+// Server.Publish sends an event named after the topic to every Conn
+// with a matching pattern.  Subscribers receive published events
+// through their EventHandler like any other event.
+//
+// Topics are dot-separated tokens ("orders.eu.created").  In a
+// pattern, "*" matches exactly one token and ">", as the last token,
+// matches one or more: "orders.*.created" and "orders.>" both match
+// the topic above.
+//
+// Subscriptions are requests to the reserved methods armie.Subscribe
+// and armie.Unsubscribe, so a Policy can restrict who may subscribe.
+// They belong to the Conn and are not restored by a ReconnectingConn.
+//
+const (
+	subscribeMethod   = "armie.Subscribe"
+	unsubscribeMethod = "armie.Unsubscribe"
+)
+
+//
+// Check that pattern is a well-formed topic pattern.
+//
+func ValidTopicPattern(pattern string) error {
+	if pattern == "" {
+		return fmt.Errorf("empty topic pattern")
+	}
+	tokens := strings.Split(pattern, ".")
+	for i, tok := range tokens {
+		switch {
+		case tok == "":
+			return fmt.Errorf("empty token in topic pattern %q", pattern)
+		case tok == ">" && i != len(tokens)-1:
+			return fmt.Errorf("wildcard > must be the last token in topic pattern %q", pattern)
+		case tok != "*" && tok != ">" && strings.ContainsAny(tok, "*>"):
+			return fmt.Errorf("wildcard must be a whole token in topic pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+//
+// Whether topic matches pattern.
+//
+func MatchTopic(pattern, topic string) bool {
+	pt := strings.Split(pattern, ".")
+	tt := strings.Split(topic, ".")
+	for i, tok := range pt {
+		if tok == ">" {
+			return len(tt) > i
+		}
+		if i >= len(tt) || (tok != "*" && tok != tt[i]) {
+			return false
+		}
+	}
+	return len(pt) == len(tt)
+}
+
+//
+// Subscribe to events published by the Server on topics matching
+// pattern.  Subscribing to the same pattern twice has no further
+// effect.
+//
+func (c *Conn) Subscribe(pattern string) error {
+	return c.subscription(subscribeMethod, pattern)
+}
+
+//
+// Remove a subscription made by Subscribe with the same pattern.
+//
+func (c *Conn) Unsubscribe(pattern string) error {
+	return c.subscription(unsubscribeMethod, pattern)
+}
+
+func (c *Conn) subscription(method, pattern string) error {
+	if err := ValidTopicPattern(pattern); err != nil {
+		return err
+	}
+	f, err := c.SendRequest(method, pattern)
+	if err != nil {
+		return err
+	}
+	return f.GetResult(nil)
+}
+
+//
+// The topic patterns each Conn of a Server has subscribed to.
+//
+type subscriptions struct {
+	mu    sync.RWMutex
+	conns map[*Conn]map[string]struct{}
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{
+		conns: make(map[*Conn]map[string]struct{}),
+	}
+}
+
+func (s *subscriptions) add(c *Conn, pattern string) error {
+	if err := ValidTopicPattern(pattern); err != nil {
+		return Errorf(CodeInvalidArgument, "%v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the Conn may have closed, and been dropped, while the request
+	// was dispatched
+	select {
+	case <-c.Done():
+		return ErrConnectionClosed
+	default:
+	}
+	patterns := s.conns[c]
+	if patterns == nil {
+		patterns = make(map[string]struct{})
+		s.conns[c] = patterns
+	}
+	patterns[pattern] = struct{}{}
+	return nil
+}
+
+func (s *subscriptions) remove(c *Conn, pattern string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if patterns := s.conns[c]; patterns != nil {
+		delete(patterns, pattern)
+		if len(patterns) == 0 {
+			delete(s.conns, c)
+		}
+	}
+}
+
+func (s *subscriptions) drop(c *Conn) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+}
+
+func (s *subscriptions) matching(topic string) []*Conn {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var conns []*Conn
+	for c, patterns := range s.conns {
+		for pattern := range patterns {
+			if MatchTopic(pattern, topic) {
+				conns = append(conns, c)
+				break
+			}
+		}
+	}
+	return conns
+}
+
+func (serv *Server) handleSubscribe(req *Request, response *Response) {
+	response.Reply(req.CallMethod(func(pattern string) error {
+		return serv.subs.add(response.conn, pattern)
+	}))
+}
+
+func (serv *Server) handleUnsubscribe(req *Request, response *Response) {
+	response.Reply(req.CallMethod(func(pattern string) {
+		serv.subs.remove(response.conn, pattern)
+	}))
+}
+
+//
+// Send data as an event named topic to every Conn subscribed to a
+// matching pattern, once per Conn however many of its patterns match.
+// Publish never waits for a slow subscriber: one whose flow control
+// window is full is skipped, and misses the event.  Returns the number
+// of subscribers it was sent to; skipped subscribers and failures are
+// logged.
+//
+func (serv *Server) Publish(topic string, data interface{}) int {
+	return serv.PublishContext(context.Background(), topic, data)
+}
+
+//
+// Publish, passing ctx to client event interceptors.
+//
+func (serv *Server) PublishContext(ctx context.Context, topic string, data interface{}) int {
+	ctx = context.WithValue(ctx, noWaitKey{}, true)
+	sent := 0
+	for _, c := range serv.subs.matching(topic) {
+		err := c.SendEventContext(ctx, topic, data)
+		switch {
+		case errors.Is(err, errWindowFull):
+			serv.logger.Warn("[RPC] Skipping slow subscriber %v for %q", c.addr, topic)
+		case err != nil:
+			serv.logger.Warn("[RPC] Publishing %q to %v: %v", topic, c.addr, err)
+		default:
+			sent++
+		}
+	}
+	return sent
+}
@@ -0,0 +1,347 @@
+package armie
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/fred-lewis/armie/log"
+)
+
+//
+// The state of a ReconnectingConn.
+//
+type ConnState int
+
+const (
+	StateConnecting ConnState = iota + 1
+	StateConnected
+	StateDisconnected
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
+}
+
+//
+// What to do with new requests and events while a ReconnectingConn
+// is not connected.
+//
+type OutagePolicy int
+
+const (
+	// Fail immediately with an error wrapping ErrConnectionClosed.
+	FailDuringOutage OutagePolicy = iota
+	// Block until the connection is re-established, the caller's
+	// context is done, or the ReconnectingConn is closed.
+	QueueDuringOutage
+)
+
+//
+// ErrOutageQueueFull is returned under QueueDuringOutage when
+// ReconnectOptions.MaxQueued callers are already waiting.
+//
+var ErrOutageQueueFull = errors.New("outage queue full")
+
+type StateHandler func(state ConnState, err error)
+
+//
+// Tuning for a ReconnectingConn.  Zero values select the defaults.
+//
+type ReconnectOptions struct {
+	InitialBackoff time.Duration // default 100ms
+	MaxBackoff     time.Duration // default 30s
+	Multiplier     float64       // default 2
+	Jitter         float64       // fraction of each delay randomized, default 0.2
+	Policy         OutagePolicy
+	MaxQueued      int // callers allowed to wait during an outage, 0 is unlimited
+}
+
+func (o *ReconnectOptions) setDefaults() {
+	if o.InitialBackoff <= 0 {
+		o.InitialBackoff = 100 * time.Millisecond
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = 30 * time.Second
+	}
+	if o.MaxBackoff < o.InitialBackoff {
+		o.MaxBackoff = o.InitialBackoff
+	}
+	if o.Multiplier < 1 {
+		o.Multiplier = 2
+	}
+	if o.Jitter <= 0 || o.Jitter > 1 {
+		o.Jitter = 0.2
+	}
+}
+
+//
+// ReconnectingConn is a client connection that redials with
+// exponential backoff and jitter whenever the underlying Conn is
+// lost.  The ConnectionHandler is re-run on every new Conn, so
+// Request and Event handlers are wired up again after each redial.
+//
+// Requests outstanding when a Conn is lost are not retried: their
+// Futures fail with ErrConnectionClosed.  New requests and events
+// made during an outage are failed or queued per the OutagePolicy.
+//
+type ReconnectingConn struct {
+	transport    Transport
+	addr         string
+	connOpts     Options
+	logger       *log.Logger
+	opts         ReconnectOptions
+	mu           sync.Mutex
+	conn         *Conn
+	state        ConnState
+	ready        chan struct{}
+	queued       int
+	stateHandler StateHandler
+	closeOnce    sync.Once
+	closed       chan struct{}
+	loopDone     chan struct{}
+}
+
+//
+// Create a ReconnectingConn that dials addr over TCP.  The first
+// dial happens in the background; use OnStateChange or the
+// QueueDuringOutage policy to wait for it.
+//
+func NewReconnectingTCPConnection(addr string, logout io.Writer, handler ConnectionHandler, opts ReconnectOptions) *ReconnectingConn {
+	return DialReconnecting(TCPTransport(), addr, &Options{Logger: logout, ConnectionHandler: handler}, opts)
+}
+
+//
+// Create a ReconnectingConn that dials addr over the given Transport,
+// creating each Conn with connOpts (which may be nil).
+//
+func DialReconnecting(transport Transport, addr string, connOpts *Options, opts ReconnectOptions) *ReconnectingConn {
+	opts.setDefaults()
+	if connOpts == nil {
+		connOpts = &Options{}
+	}
+
+	rc := &ReconnectingConn{
+		transport: transport,
+		addr:      addr,
+		connOpts:  *connOpts,
+		logger:    log.New(connOpts.Logger),
+		opts:      opts,
+		state:     StateConnecting,
+		ready:     make(chan struct{}),
+		closed:    make(chan struct{}),
+		loopDone:  make(chan struct{}),
+	}
+
+	go rc.run()
+
+	return rc
+}
+
+//
+// Register a handler called on every state change.  Handlers run on
+// the reconnect goroutine and should not block.
+//
+func (rc *ReconnectingConn) OnStateChange(handler StateHandler) {
+	rc.mu.Lock()
+	rc.stateHandler = handler
+	rc.mu.Unlock()
+}
+
+//
+// The current connection state.
+//
+func (rc *ReconnectingConn) State() ConnState {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.state
+}
+
+//
+// The current underlying Conn, or nil during an outage.
+//
+func (rc *ReconnectingConn) Conn() *Conn {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.conn
+}
+
+//
+// Send an asynchronous RMI Request on the current Conn.
+//
+func (rc *ReconnectingConn) SendRequest(method string, args ...interface{}) (*Future, error) {
+	return rc.SendRequestContext(context.Background(), method, args...)
+}
+
+//
+// Send an asynchronous RMI Request on the current Conn.  Under
+// QueueDuringOutage, ctx also bounds the wait for reconnection.
+//
+func (rc *ReconnectingConn) SendRequestContext(ctx context.Context, method string, args ...interface{}) (*Future, error) {
+	c, err := rc.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.SendRequestContext(ctx, method, args...)
+}
+
+//
+// Send an asynchronous Event on the current Conn.
+//
+func (rc *ReconnectingConn) SendEvent(method string, data interface{}) error {
+	return rc.SendEventContext(context.Background(), method, data)
+}
+
+//
+// Send an asynchronous Event on the current Conn, with the metadata
+// attached to ctx.
+//
+func (rc *ReconnectingConn) SendEventContext(ctx context.Context, method string, data interface{}) error {
+	c, err := rc.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	return c.SendEventContext(ctx, method, data)
+}
+
+//
+// Stop reconnecting and close the current Conn.  Close will not
+// return until the reconnect goroutine exits.
+//
+func (rc *ReconnectingConn) Close() error {
+	err := fmt.Errorf("shutdown on closed connection")
+	rc.closeOnce.Do(func() {
+		close(rc.closed)
+		err = nil
+	})
+	<-rc.loopDone
+	return err
+}
+
+func (rc *ReconnectingConn) acquire(ctx context.Context) (*Conn, error) {
+	for {
+		rc.mu.Lock()
+		if rc.state == StateClosed {
+			rc.mu.Unlock()
+			return nil, fmt.Errorf("reconnecting connection closed: %w", ErrConnectionClosed)
+		}
+		if rc.conn != nil && rc.conn.IsAlive() {
+			c := rc.conn
+			rc.mu.Unlock()
+			return c, nil
+		}
+		if rc.opts.Policy == FailDuringOutage {
+			rc.mu.Unlock()
+			return nil, fmt.Errorf("not connected to %s: %w", rc.addr, ErrConnectionClosed)
+		}
+		if rc.opts.MaxQueued > 0 && rc.queued >= rc.opts.MaxQueued {
+			rc.mu.Unlock()
+			return nil, ErrOutageQueueFull
+		}
+		rc.queued++
+		ready := rc.ready
+		rc.mu.Unlock()
+
+		var err error
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-rc.closed:
+			err = fmt.Errorf("reconnecting connection closed: %w", ErrConnectionClosed)
+		}
+
+		rc.mu.Lock()
+		rc.queued--
+		rc.mu.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (rc *ReconnectingConn) setState(state ConnState, conn *Conn, err error) {
+	rc.mu.Lock()
+	rc.state = state
+	switch state {
+	case StateConnected:
+		rc.conn = conn
+		close(rc.ready)
+	case StateDisconnected:
+		rc.conn = nil
+		rc.ready = make(chan struct{})
+	case StateClosed:
+		rc.conn = nil
+	}
+	handler := rc.stateHandler
+	rc.mu.Unlock()
+
+	if handler != nil {
+		handler(state, err)
+	}
+}
+
+func (rc *ReconnectingConn) run() {
+	defer close(rc.loopDone)
+
+	backoff := rc.opts.InitialBackoff
+	for {
+		tc, err := rc.transport.Dial(rc.addr)
+		var c *Conn
+		if err == nil {
+			c, err = newConn(tc, &rc.connOpts)
+		}
+
+		if err != nil {
+			rc.logger.Warn("[RPC] connecting to %s: %v", rc.addr, err)
+			select {
+			case <-rc.closed:
+				rc.setState(StateClosed, nil, nil)
+				return
+			case <-time.After(rc.jitter(backoff)):
+			}
+			backoff = time.Duration(float64(backoff) * rc.opts.Multiplier)
+			if backoff > rc.opts.MaxBackoff {
+				backoff = rc.opts.MaxBackoff
+			}
+			continue
+		}
+
+		backoff = rc.opts.InitialBackoff
+		rc.logger.Info("[RPC] Connected to %s", rc.addr)
+		rc.setState(StateConnected, c, nil)
+
+		select {
+		case <-c.Done():
+			err = c.Err()
+			rc.logger.Warn("[RPC] lost connection to %s: %v", rc.addr, err)
+			rc.setState(StateDisconnected, nil, err)
+			rc.setState(StateConnecting, nil, nil)
+		case <-rc.closed:
+			c.Close()
+			rc.setState(StateClosed, nil, nil)
+			return
+		}
+	}
+}
+
+func (rc *ReconnectingConn) jitter(d time.Duration) time.Duration {
+	f := 1 + rc.opts.Jitter*(rand.Float64()*2-1)
+	return time.Duration(float64(d) * f)
+}
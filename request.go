@@ -1,28 +1,42 @@
 package armie
 
 import (
+	"context"
+	"errors"
 	"reflect"
 	"bytes"
 	"math/rand"
-	"time"
 	"io"
-	"fmt"
+	"sync"
 	"github.com/ugorji/go/codec"
 )
 
 //
-// An RMI request containing encoded arguments and a method name
+// An RMI request containing encoded arguments and a method name,
+// and any metadata the caller sent with it.
 //
 type Request struct {
-	Method  string
-	Id      uint64
-	Payload []byte
+	Method   string
+	Id       uint64
+	Payload  []byte
+	Metadata Metadata
+	ctx      context.Context
 }
 
 func genID() uint64 {
-	s1 := rand.NewSource(time.Now().UnixNano())
-	r1 := rand.New(s1)
-	return r1.Uint64()
+	return rand.Uint64()
+}
+
+//
+// The context of the request.  It is cancelled when the caller
+// abandons the request (or its deadline passes), and once the
+// Response has been sent.
+//
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
 }
 
 //
@@ -53,7 +67,8 @@ func (r *Request) DecodeArgs(types []reflect.Type) ([]interface{}, error) {
 //
 // Decode request arguments to match the method args, and call the method.
 // The method can return an error and, at most one other object, which will
-// in-turn be returned by CallMethod.
+// in-turn be returned by CallMethod.  Errors implementing Coder are
+// returned as a *RemoteError.
 //
 func (r *Request) CallMethod(method interface{}) (interface{}, error) {
 	types := make([]reflect.Type, 0)
@@ -65,43 +80,111 @@ func (r *Request) CallMethod(method interface{}) (interface{}, error) {
 
 	args, err := r.DecodeArgs(types)
 	if err != nil {
-		return nil, fmt.Errorf("decoding RPC arguments: %v", err)
+		return nil, Errorf(CodeInvalidArgument, "decoding RPC arguments: %v", err)
 	}
 
 	vargs := make([]reflect.Value, 0)
-	for _, arg := range args {
-		vargs = append(vargs, reflect.ValueOf(arg))
+	for i, arg := range args {
+		if arg == nil {
+			vargs = append(vargs, reflect.Zero(types[i]))
+		} else {
+			vargs = append(vargs, reflect.ValueOf(arg))
+		}
 	}
 
 	var res interface{}
 	results := reflect.ValueOf(method).Call(vargs)
 
 	for _, result := range results {
-		switch result.Kind() {
-		case reflect.Interface:
-			v := result.Interface()
-			ok := false
-			err, ok = v.(error)
-			if !ok {
-				res = v
+		switch {
+		case result.Type() == errorType:
+			if !result.IsNil() {
+				err = result.Interface().(error)
 			}
 		default:
 			res = result.Interface()
 		}
 	}
 
+	var coder Coder
+	if err != nil && errors.As(err, &coder) {
+		// a copy: the handler's error may be shared, e.g. a sentinel
+		cp := *toRemoteError(err)
+		cp.Method = r.Method
+		err = &cp
+	}
+
 	return res, err
 }
 
+//
+// ErrResponseSent is returned when a Response is used after it has
+// already been sent.
+//
+var ErrResponseSent = errors.New("response already sent")
+
 //
 // Response is passed to a RequestHandler to allow the RequestHandler
-// to send a result or an error.
+// to send a result or an error.  A handler that returns without
+// sending either is answered with a CodeInternal error, unless it
+// called Detach to respond later.  Trailer is sent to the caller with
+// the result or error.
 //
 type Response struct {
 	Id        uint64
 	ErrString string
 	Result    interface{}
+	Trailer   Metadata
 	conn      *Conn
+	ctx       context.Context
+	in        *msgQueue
+	err       *RemoteError
+	mu        sync.Mutex
+	sent      bool
+	detached  bool
+	streaming bool
+}
+
+//
+// Keep the Response usable after the RequestHandler returns, for
+// handlers that respond asynchronously.  The handler is then
+// responsible for eventually calling Send or Error.
+//
+func (r *Response) Detach() {
+	r.mu.Lock()
+	r.detached = true
+	r.mu.Unlock()
+}
+
+//
+// Set a trailer entry, to be sent with the result or error.
+//
+func (r *Response) SetTrailer(key, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Trailer == nil {
+		r.Trailer = make(Metadata)
+	}
+	r.Trailer[key] = value
+}
+
+func (r *Response) markSent() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sent {
+		return false
+	}
+	r.sent = true
+	return true
+}
+
+//
+// Whether the Response has been sent or handed off with Detach.
+//
+func (r *Response) settled() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sent || r.detached
 }
 
 //
@@ -109,7 +192,11 @@ type Response struct {
 // no longer usable.
 //
 func (r *Response) Send(result interface{}) error {
+	if !r.markSent() {
+		return ErrResponseSent
+	}
 	r.Result = result
+	defer r.conn.finishRequest(r.Id)
 	return encodeResponse(r.conn, r)
 }
 
@@ -118,16 +205,52 @@ func (r *Response) Send(result interface{}) error {
 // no longer usable.
 //
 func (r *Response) Error(err string) error {
+	if !r.markSent() {
+		return ErrResponseSent
+	}
 	r.ErrString = err
+	defer r.conn.finishRequest(r.Id)
 	return encodeResponse(r.conn, r)
 }
 
 //
-// An event containing an event name and an encoded payload.
+// Send the given error with its code and details: a *RemoteError is
+// sent as-is, errors implementing Coder (and Detailer) carry their
+// code (and details), and any other error is sent as CodeUnknown.
+// After an error is sent, the Response is no longer usable.
+//
+func (r *Response) SendError(err error) error {
+	if !r.markSent() {
+		return ErrResponseSent
+	}
+	r.err = toRemoteError(err)
+	r.ErrString = r.err.Message
+	if r.ErrString == "" {
+		r.ErrString = r.err.Code.String()
+	}
+	defer r.conn.finishRequest(r.Id)
+	return encodeResponse(r.conn, r)
+}
+
+//
+// Send err if it is not nil, otherwise send result.  Convenient for
+// replying with the results of CallMethod.
+//
+func (r *Response) Reply(result interface{}, err error) error {
+	if err != nil {
+		return r.SendError(err)
+	}
+	return r.Send(result)
+}
+
+//
+// An event containing an event name, an encoded payload and any
+// metadata the sender attached.
 //
 type Event struct {
-	Event   string
-	Payload []byte
+	Event    string
+	Payload  []byte
+	Metadata Metadata
 }
 
 func (e *Event) Decode(v interface{}) error {
@@ -0,0 +1,167 @@
+package armie
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+//
+// A set of methods callable by name, populated by Register and
+// RegisterFunc.  Conns consult their own registry, then their
+// Server's.
+//
+type registry struct {
+	mu    sync.RWMutex
+	funcs map[string]interface{}
+}
+
+func newRegistry() *registry {
+	return &registry{
+		funcs: make(map[string]interface{}),
+	}
+}
+
+func (r *registry) register(name string, svc interface{}) error {
+	v := reflect.ValueOf(svc)
+	if !v.IsValid() {
+		return fmt.Errorf("cannot register nil service")
+	}
+	if name == "" {
+		name = reflect.Indirect(v).Type().Name()
+	}
+	if name == "" {
+		return fmt.Errorf("cannot register unnamed type %v without a name", v.Type())
+	}
+
+	funcs := make(map[string]interface{})
+	t := v.Type()
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		if m.PkgPath != "" {
+			continue
+		}
+		if checkFunc(m.Type) != nil {
+			continue
+		}
+		funcs[name+"."+m.Name] = v.Method(i).Interface()
+	}
+
+	if len(funcs) == 0 {
+		return fmt.Errorf("service %s has no exported methods suitable for RMI", name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for method, fn := range funcs {
+		r.funcs[method] = fn
+	}
+	return nil
+}
+
+func (r *registry) registerFunc(method string, fn interface{}) error {
+	t := reflect.TypeOf(fn)
+	if t == nil || t.Kind() != reflect.Func {
+		return fmt.Errorf("cannot register %v as %s: not a func", t, method)
+	}
+	if err := checkFunc(t); err != nil {
+		return fmt.Errorf("cannot register %s: %v", method, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.funcs[method] = fn
+	return nil
+}
+
+func (r *registry) registerStream(method string, handler StreamHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.funcs[method] = handler
+}
+
+func (r *registry) registerHandler(method string, handler RequestHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.funcs[method] = handler
+}
+
+func (r *registry) lookup(method string) interface{} {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.funcs[method]
+}
+
+//
+// Check that a func can be invoked by Request.CallMethod: fixed
+// arguments, returning at most one value and an optional error.
+//
+func checkFunc(t reflect.Type) error {
+	if t.IsVariadic() {
+		return fmt.Errorf("variadic funcs are not supported")
+	}
+	switch t.NumOut() {
+	case 0, 1:
+	case 2:
+		if t.Out(1) != errorType {
+			return fmt.Errorf("second result must be an error")
+		}
+	default:
+		return fmt.Errorf("at most one result and an error are supported")
+	}
+	return nil
+}
+
+//
+// Answer a request by calling fn through CallMethod.
+//
+func serveFunc(fn interface{}, req *Request, response *Response) {
+	response.Reply(req.CallMethod(fn))
+}
+
+//
+// Expose every exported method of svc as an RMI endpoint named
+// "name.Method".  If name is empty, the type name of svc is used.
+// Arguments are decoded as in Request.CallMethod, and the result or
+// error is sent automatically.  Registered methods take precedence
+// over the RequestHandler; requests for unknown methods get an error
+// response if no RequestHandler is registered.
+//
+func (c *Conn) Register(name string, svc interface{}) error {
+	return c.services.register(name, svc)
+}
+
+//
+// Expose a single func as the RMI endpoint method.
+//
+func (c *Conn) RegisterFunc(method string, fn interface{}) error {
+	return c.services.registerFunc(method, fn)
+}
+
+//
+// Register a service on every connection accepted by the Server,
+// including those already accepted.  See Conn.Register.
+//
+func (serv *Server) Register(name string, svc interface{}) error {
+	return serv.services.register(name, svc)
+}
+
+//
+// Register a func on every connection accepted by the Server.
+// See Conn.RegisterFunc.
+//
+func (serv *Server) RegisterFunc(method string, fn interface{}) error {
+	return serv.services.registerFunc(method, fn)
+}
+
+func (c *Conn) lookupService(method string) interface{} {
+	if fn := c.services.lookup(method); fn != nil {
+		return fn
+	}
+	return c.serverServices.lookup(method)
+}
@@ -0,0 +1,575 @@
+package armie
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+//
+// ErrStreamClosed is returned by Recv after the Stream was closed
+// locally.
+//
+var ErrStreamClosed = errors.New("stream closed")
+
+//
+// A queue of encoded messages, ended by the sender or an error.
+//
+type msgQueue struct {
+	mu       sync.Mutex
+	msgs     []queued
+	ready    chan struct{}
+	done     chan struct{}
+	once     sync.Once
+	err      error
+	closed   error
+	consumed func(credit int)
+}
+
+//
+// A message and the flow control credit to return once it is
+// consumed.
+//
+type queued struct {
+	msg    []byte
+	credit int
+}
+
+func newMsgQueue(consumed func(credit int)) *msgQueue {
+	return &msgQueue{
+		ready:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		consumed: consumed,
+	}
+}
+
+func (q *msgQueue) push(msg []byte, credit int) {
+	q.mu.Lock()
+	if q.closed != nil {
+		q.mu.Unlock()
+		q.credit([]queued{{msg, credit}})
+		return
+	}
+	q.msgs = append(q.msgs, queued{msg, credit})
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+//
+// End the queue: once drained, recv returns err, or io.EOF if err is
+// nil.
+//
+func (q *msgQueue) end(err error) {
+	q.once.Do(func() {
+		q.mu.Lock()
+		q.err = err
+		q.mu.Unlock()
+		close(q.done)
+	})
+}
+
+func (q *msgQueue) pop() ([]byte, bool) {
+	q.mu.Lock()
+	if len(q.msgs) == 0 {
+		q.mu.Unlock()
+		return nil, false
+	}
+	m := q.msgs[0]
+	q.msgs = q.msgs[1:]
+	q.mu.Unlock()
+
+	if m.credit > 0 && q.consumed != nil {
+		q.consumed(m.credit)
+	}
+	return m.msg, true
+}
+
+//
+// Drop any messages not yet received, returning their credit.
+//
+func (q *msgQueue) discard() {
+	q.mu.Lock()
+	msgs := q.msgs
+	q.msgs = nil
+	q.mu.Unlock()
+	q.credit(msgs)
+}
+
+//
+// Discard the queue's messages, and any that arrive later, and have
+// recv return err from now on.
+//
+func (q *msgQueue) close(err error) {
+	q.mu.Lock()
+	q.closed = err
+	q.mu.Unlock()
+	q.discard()
+}
+
+func (q *msgQueue) credit(msgs []queued) {
+	for _, m := range msgs {
+		if m.credit > 0 && q.consumed != nil {
+			q.consumed(m.credit)
+		}
+	}
+}
+
+//
+// Await the next message and decode it into v.  When ctx is done,
+// cancel is called if it is not nil and the queue is expected to end;
+// otherwise ctx.Err() is returned.
+//
+func (q *msgQueue) recv(ctx context.Context, v interface{}, cancel func(error)) error {
+	for {
+		q.mu.Lock()
+		closed := q.closed
+		q.mu.Unlock()
+		if closed != nil {
+			return closed
+		}
+
+		if msg, ok := q.pop(); ok {
+			if v == nil {
+				return nil
+			}
+			return decodeBytes(msg, v)
+		}
+
+		select {
+		case <-q.ready:
+		case <-q.done:
+			q.mu.Lock()
+			n, err := len(q.msgs), q.err
+			q.mu.Unlock()
+			if n > 0 {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			return io.EOF
+		case <-ctx.Done():
+			if cancel == nil {
+				return ctx.Err()
+			}
+			cancel(ctx.Err())
+		}
+	}
+}
+
+//
+// A Stream is the caller's end of a streaming request.  It receives
+// the messages a RequestHandler sends through Response.Stream, in
+// order; a handler that replies with a single result instead is seen
+// as a stream of one message.  A Stream opened with OpenStream can
+// also send messages to the handler.
+//
+type Stream struct {
+	conn      *Conn
+	id        uint64
+	method    string
+	in        *msgQueue
+	res       *frame
+	future    *Future
+	sendMu    sync.Mutex
+	sendsDone bool
+}
+
+func newStream(conn *Conn, id uint64, method string) *Stream {
+	s := &Stream{
+		conn:   conn,
+		id:     id,
+		method: method,
+	}
+	s.in = newMsgQueue(func(credit int) {
+		select {
+		case <-s.in.done:
+			// the stream's window is gone; only the connection's remains
+			conn.consumed(0, credit)
+		default:
+			conn.consumed(id, credit)
+		}
+	})
+	// what client interceptors see of the stream
+	s.future = newFuture(conn, id, method)
+	s.future.abandon = s.cancel
+	return s
+}
+
+//
+// Send an RMI Request whose handler streams its results.  If ctx is
+// cancelled or its deadline passes, the stream fails with ctx.Err()
+// and the peer is sent a cancel, as with SendRequestContext.
+//
+func (c *Conn) SendStreamRequest(ctx context.Context, method string, args ...interface{}) (*Stream, error) {
+	s, err := c.OpenStream(ctx, method, args...)
+	if err != nil {
+		return nil, err
+	}
+	s.CloseSend()
+	return s, nil
+}
+
+//
+// Open a bidirectional stream to the StreamHandler registered for
+// method, passing it args like a request.  Both ends Send and Recv
+// until the handler returns; the caller may CloseSend first to signal
+// it has nothing more to send.  Cancellation is as for
+// SendStreamRequest.
+//
+// Client interceptors run around opening the stream as around any
+// request; the Future they get from next completes when the stream
+// ends.  An interceptor that returns without calling next fails the
+// open.
+//
+func (c *Conn) OpenStream(ctx context.Context, method string, args ...interface{}) (*Stream, error) {
+	var s *Stream
+	open := func(ctx context.Context, method string, args []interface{}) (*Future, error) {
+		var err error
+		s, err = c.openStream(ctx, method, args)
+		if err != nil {
+			return nil, err
+		}
+		return s.future, nil
+	}
+
+	if _, err := c.chainClient(open)(ctx, method, args); err != nil {
+		if s != nil {
+			s.Close()
+		}
+		return nil, err
+	}
+	if s == nil {
+		return nil, fmt.Errorf("stream %s not opened: a client interceptor did not call next", method)
+	}
+	return s, nil
+}
+
+func (c *Conn) openStream(ctx context.Context, method string, args []interface{}) (*Stream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var deadline int64
+	if d, ok := ctx.Deadline(); ok {
+		deadline = d.UnixNano()
+	}
+
+	req := &Request{
+		Method:   method,
+		Id:       genID(),
+		Metadata: c.outgoingMetadata(ctx),
+	}
+	s := newStream(c, req.Id, method)
+
+	if err := c.sendRequest(req, deadline, args, s); err != nil {
+		return nil, err
+	}
+
+	c.watch(ctx, s.in.done, s.cancel)
+
+	return s, nil
+}
+
+func (c *Conn) handleStream(frm *frame) {
+	c.mu.Lock()
+	p := c.outstanding[frm.Id]
+	c.mu.Unlock()
+
+	s, ok := p.(*Stream)
+	if !ok {
+		c.logger.Trace("[RPC] Dropping stream message for request %v", frm.Id)
+		c.consumed(0, len(frm.Payload))
+		return
+	}
+	s.in.push(frm.Payload, len(frm.Payload))
+}
+
+func (s *Stream) finish(res *frame, err error) {
+	if err == nil && res != nil && len(res.Payload) > 0 {
+		// a single result, which is not flow controlled
+		s.in.push(res.Payload, 0)
+	}
+	s.in.mu.Lock()
+	s.res = res
+	s.in.mu.Unlock()
+	s.in.end(err)
+	s.conn.forgetStream(s.id)
+	s.future.finish(res, err)
+}
+
+func (s *Stream) requestMethod() string {
+	return s.method
+}
+
+func (s *Stream) cancel(err error) {
+	if s.conn.cancelRequest(s.id) {
+		s.finish(nil, err)
+	}
+}
+
+//
+// Await the next message and decode it into v, which may be nil to
+// skip it.  Returns io.EOF once the handler has closed the stream and
+// every message has been received, or the error it closed the stream
+// with as a *RemoteError.
+//
+func (s *Stream) Recv(v interface{}) error {
+	return s.RecvContext(context.Background(), v)
+}
+
+//
+// Await the next message, giving up when ctx is done.  As with
+// Future.GetResultContext, the request is then abandoned and the peer
+// sent a cancel.
+//
+func (s *Stream) RecvContext(ctx context.Context, v interface{}) error {
+	return s.in.recv(ctx, v, s.cancel)
+}
+
+//
+// Send a message to the handler.  Fails once CloseSend has been
+// called or the stream has ended.
+//
+func (s *Stream) Send(msg interface{}) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if s.sendsDone {
+		return fmt.Errorf("send on %s stream after CloseSend: %w", s.method, ErrStreamClosed)
+	}
+	select {
+	case <-s.in.done:
+		return fmt.Errorf("send on finished %s stream: %w", s.method, ErrStreamClosed)
+	default:
+	}
+
+	payload := encodeBytes(msg)
+	if err := s.conn.acquireCredit(context.Background(), s.in.done, s.id, len(payload)); err != nil {
+		return err
+	}
+	return encodeSend(s.conn, s.id, payload)
+}
+
+//
+// Tell the handler no more messages will be sent; its Recv returns
+// io.EOF once it has received the rest.  The stream stays open for
+// receiving.
+//
+func (s *Stream) CloseSend() error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if s.sendsDone {
+		return nil
+	}
+	s.sendsDone = true
+	select {
+	case <-s.in.done:
+		return nil
+	default:
+	}
+	return encodeHalfClose(s.conn, s.id)
+}
+
+//
+// Cancel the stream: the peer is sent a cancel, which the handler
+// observes through its context, and further calls to Recv return
+// ErrStreamClosed.  Messages already received are discarded, even if
+// the handler had already finished.
+//
+func (s *Stream) Close() error {
+	s.cancel(ErrStreamClosed)
+	s.in.close(ErrStreamClosed)
+	return nil
+}
+
+//
+// The trailer the peer sent when it closed the stream.  Nil until
+// Recv has returned io.EOF or an error.
+//
+func (s *Stream) Trailer() Metadata {
+	select {
+	case <-s.in.done:
+	default:
+		return nil
+	}
+	s.in.mu.Lock()
+	defer s.in.mu.Unlock()
+	if s.res == nil {
+		return nil
+	}
+	return s.res.Meta
+}
+
+//
+// ServerStream is the handler's end of a streaming request: it sends
+// messages in answer to the request and, for a StreamHandler,
+// receives the messages the caller sends.
+//
+type ServerStream struct {
+	res *Response
+}
+
+//
+// StreamHandler answers a stream opened with OpenStream.  The
+// arguments the stream was opened with are in req, as for a
+// RequestHandler.  When the handler returns the stream is closed, with
+// the returned error if it is not nil, unless it was closed already or
+// the handler called Detach on the Response.
+//
+type StreamHandler func(req *Request, stream *ServerStream) error
+
+//
+// Register a StreamHandler for method.  Streams to methods with no
+// StreamHandler are answered by the registered method or
+// RequestHandler, and any messages the caller sends are dropped.
+//
+func (c *Conn) RegisterStream(method string, handler StreamHandler) {
+	c.services.registerStream(method, handler)
+}
+
+//
+// Register a StreamHandler on every connection accepted by the Server.
+//
+func (serv *Server) RegisterStream(method string, handler StreamHandler) {
+	serv.services.registerStream(method, handler)
+}
+
+func (c *Conn) serveStream(handler StreamHandler, req *Request, response *Response) {
+	stream := response.Stream()
+	err := handler(req, stream)
+	if response.settled() {
+		return
+	}
+	if err != nil {
+		stream.CloseWithError(err)
+	} else {
+		stream.Close()
+	}
+}
+
+//
+// The queue for messages the caller sends on the stream to request
+// id, if it is being answered by a StreamHandler.
+//
+func (c *Conn) inboundStream(id uint64) *msgQueue {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inbound[id]
+}
+
+func (c *Conn) handleSend(frm *frame) {
+	if q := c.inboundStream(frm.Id); q != nil {
+		q.push(frm.Payload, len(frm.Payload))
+	} else {
+		c.logger.Trace("[RPC] Dropping stream message for request %v", frm.Id)
+		c.consumed(0, len(frm.Payload))
+	}
+}
+
+func (c *Conn) handleHalfClose(frm *frame) {
+	if q := c.inboundStream(frm.Id); q != nil {
+		q.end(nil)
+	}
+}
+
+//
+// Await the next message from the caller and decode it into v, which
+// may be nil to skip it.  Returns io.EOF once the caller has called
+// CloseSend and every message has been received, and the request
+// context's error if the caller goes away.
+//
+func (s *ServerStream) Recv(v interface{}) error {
+	return s.RecvContext(context.Background(), v)
+}
+
+//
+// Await the next message from the caller, giving up when ctx is done.
+//
+func (s *ServerStream) RecvContext(ctx context.Context, v interface{}) error {
+	if s.res.in == nil {
+		return io.EOF
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(s.Context(), cancel)
+	defer stop()
+
+	err := s.res.in.recv(ctx, v, nil)
+	if err != nil && s.Context().Err() != nil {
+		return s.Context().Err()
+	}
+	return err
+}
+
+//
+// Answer the request with a stream of messages instead of a single
+// result.  The handler, or a goroutine it hands the stream to after
+// calling Detach, must finish with Close or CloseWithError; the
+// Response's Trailer is sent then.
+//
+func (r *Response) Stream() *ServerStream {
+	r.mu.Lock()
+	r.streaming = true
+	r.mu.Unlock()
+	return &ServerStream{r}
+}
+
+func (r *Response) isStreaming() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.streaming
+}
+
+//
+// Send a message.  Fails with ErrResponseSent once the stream is
+// closed, and with the request context's error once the caller has
+// gone away.
+//
+func (s *ServerStream) Send(msg interface{}) error {
+	r := s.res
+	r.mu.Lock()
+	sent := r.sent
+	r.mu.Unlock()
+	if sent {
+		return ErrResponseSent
+	}
+	if err := s.Context().Err(); err != nil {
+		return err
+	}
+
+	payload := encodeBytes(msg)
+	if err := r.conn.acquireCredit(s.Context(), nil, r.Id, len(payload)); err != nil {
+		return err
+	}
+	return encodeStream(r.conn, r.Id, payload)
+}
+
+//
+// End the stream successfully.
+//
+func (s *ServerStream) Close() error {
+	return s.res.Send(nil)
+}
+
+//
+// End the stream with an error, sent as by Response.SendError.
+//
+func (s *ServerStream) CloseWithError(err error) error {
+	return s.res.SendError(err)
+}
+
+//
+// The context of the request being answered.
+//
+func (s *ServerStream) Context() context.Context {
+	if s.res.ctx == nil {
+		return context.Background()
+	}
+	return s.res.ctx
+}
@@ -0,0 +1,180 @@
+package armie
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "armie test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert, key, pool}
+}
+
+func (ca *testCA) issue(t *testing.T, cn string, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLSMutualAuth(t *testing.T) {
+	ca := newTestCA(t)
+
+	s := NewTLSServer(&tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "server", x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}, os.Stdout)
+	s.OnConnection(func(conn *Conn) error {
+		conn.OnRequest(func(req *Request, res *Response) {
+			chains := conn.VerifiedChains()
+			if len(chains) == 0 {
+				res.Error("unverified peer")
+				return
+			}
+			res.Send(chains[0][0].Subject.CommonName)
+		})
+		return nil
+	})
+	if err := s.Listen("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addr := s.listener.Addr().String()
+
+	conn, err := NewTLSConnection(addr, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "alice", x509.ExtKeyUsageClientAuth)},
+		RootCAs:      ca.pool,
+		ServerName:   "localhost",
+	}, os.Stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if certs := conn.PeerCertificates(); len(certs) == 0 || certs[0].Subject.CommonName != "server" {
+		t.Errorf("Unexpected server certificates: %v", certs)
+	}
+
+	f, err := conn.SendRequest("WHOAMI")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	if err := f.GetResult(&name); err != nil || name != "alice" {
+		t.Errorf("Got %q, %v", name, err)
+	}
+
+	anon, err := NewTLSConnection(addr, &tls.Config{
+		RootCAs:    ca.pool,
+		ServerName: "localhost",
+	}, os.Stdout, nil)
+	if err == nil {
+		f, err = anon.SendRequest("WHOAMI")
+		if err == nil {
+			err = f.GetResult(&name)
+		}
+		if err == nil {
+			t.Error("Connection without a client certificate was accepted")
+		}
+	}
+}
+
+func TestTLSAuthenticator(t *testing.T) {
+	ca := newTestCA(t)
+
+	s := NewServer(TLSTransport(&tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "server", x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    ca.pool,
+	}), &Options{
+		Logger:        os.Stdout,
+		Authenticator: TLSAuthenticator(nil),
+		ConnectionHandler: func(conn *Conn) error {
+			conn.OnRequest(func(req *Request, res *Response) {
+				res.Send(req.Identity().Name)
+			})
+			return nil
+		},
+	})
+	if err := s.Listen("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addr := s.listener.Addr().String()
+
+	conn, err := NewTLSConnection(addr, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "alice", x509.ExtKeyUsageClientAuth)},
+		RootCAs:      ca.pool,
+		ServerName:   "localhost",
+	}, os.Stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if name, err := Call[string](conn, "WHOAMI"); err != nil || name != "alice" {
+		t.Errorf("Got %q, %v", name, err)
+	}
+
+	_, err = NewTLSConnection(addr, &tls.Config{
+		RootCAs:    ca.pool,
+		ServerName: "localhost",
+	}, os.Stdout, nil)
+	if !errors.Is(err, CodeUnauthenticated) {
+		t.Errorf("Expected unauthenticated, got %v", err)
+	}
+}
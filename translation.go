@@ -15,6 +15,14 @@ const (
 	REQUEST = iota + 1
 	RESPONSE
 	EVENT
+	CANCEL
+	GOODBYE
+	HELLO
+	AUTH
+	STREAM
+	SEND
+	HALFCLOSE
+	WINDOW
 )
 
 type frame struct {
@@ -23,11 +31,28 @@ type frame struct {
 	Id      uint64 `codec:"i,omitempty"`
 	Error   string `codec:"e,omitempty"`
 	Payload []byte `codec:"p,omitempty"`
+	Deadline int64 `codec:"d,omitempty"`
+	Code    int32  `codec:"c,omitempty"`
+	Details []byte `codec:"x,omitempty"`
+	Stack   string `codec:"s,omitempty"`
+	Meta    map[string]string `codec:"h,omitempty"`
+	Window  int64  `codec:"w,omitempty"`
+}
+
+//
+// Implemented by sockets of message-based transports, which send each
+// frame as exactly one message rather than as part of a byte stream.
+//
+type messageWriter interface {
+	WriteMessage(p []byte) error
 }
 
 func sendFrame(conn *Conn, frm *frame) error {
 	conn.connmu.Lock()
 	defer conn.connmu.Unlock()
+	if conn.msgw != nil {
+		return conn.msgw.WriteMessage(encodeBytes(frm))
+	}
 	err := conn.enc.Encode(frm)
 	conn.bw.Flush()
 	return err
@@ -42,7 +67,7 @@ func readFrame(conn *Conn) (*frame, error) {
 	return &frm, nil
 }
 
-func encodeRequest(conn *Conn, req *Request, args []interface{}) (*frame, error) {
+func encodeRequest(conn *Conn, req *Request, deadline int64, args []interface{}) (*frame, error) {
 	argBuf := bytes.Buffer{}
 	argEnc := codec.NewEncoder(&argBuf, &mph)
 	for _, arg := range args {
@@ -54,39 +79,144 @@ func encodeRequest(conn *Conn, req *Request, args []interface{}) (*frame, error)
 		Method: req.Method,
 		Id: req.Id,
 		Payload: argBuf.Bytes(),
+		Deadline: deadline,
+		Meta: req.Metadata,
 	}
 	return frm, sendFrame(conn, frm)
 }
 
 func encodeResponse(conn *Conn, res *Response) error {
-	resBuf := bytes.Buffer{}
-	resEnc := codec.NewEncoder(&resBuf, &mph)
-	resEnc.Encode(res.Result)
-	resEnc.Release()
 	frm := frame{
 		Type: RESPONSE,
 		Id: res.Id,
 		Error: res.ErrString,
-		Payload: resBuf.Bytes(),
+		Meta: res.Trailer,
+	}
+	// the end of a stream carries no result
+	if !res.isStreaming() {
+		frm.Payload = encodeBytes(res.Result)
+	}
+	if res.err != nil {
+		frm.Code = int32(res.err.Code)
+		frm.Details = res.err.Details
+		frm.Stack = res.err.Stack
 	}
 	return sendFrame(conn, &frm)
 }
 
-func encodeEvent(conn *Conn, event string, payload interface{}) error {
-	msgBuf := bytes.Buffer{}
-	msgEnc := codec.NewEncoder(&msgBuf, &mph)
-	msgEnc.Encode(payload)
-	msgEnc.Release()
-
+func encodeEvent(conn *Conn, event string, md Metadata, payload []byte) error {
 	frm := frame{
 		Type: EVENT,
 		Method: event,
-		Payload: msgBuf.Bytes(),
+		Payload: payload,
+		Meta: md,
+	}
+
+	return sendFrame(conn, &frm)
+}
+
+func encodeStream(conn *Conn, id uint64, payload []byte) error {
+	frm := frame{
+		Type: STREAM,
+		Id: id,
+		Payload: payload,
+	}
+
+	return sendFrame(conn, &frm)
+}
+
+func encodeSend(conn *Conn, id uint64, payload []byte) error {
+	frm := frame{
+		Type: SEND,
+		Id: id,
+		Payload: payload,
+	}
+
+	return sendFrame(conn, &frm)
+}
+
+func encodeHalfClose(conn *Conn, id uint64) error {
+	frm := frame{
+		Type: HALFCLOSE,
+		Id: id,
+	}
+
+	return sendFrame(conn, &frm)
+}
+
+func encodeWindow(conn *Conn, id uint64, credit int64) error {
+	frm := frame{
+		Type: WINDOW,
+		Id: id,
+		Window: credit,
+	}
+
+	return sendFrame(conn, &frm)
+}
+
+func encodeCancel(conn *Conn, id uint64) error {
+	frm := frame{
+		Type: CANCEL,
+		Id: id,
+	}
+
+	return sendFrame(conn, &frm)
+}
+
+func encodeGoodbye(conn *Conn) error {
+	frm := frame{
+		Type: GOODBYE,
 	}
 
 	return sendFrame(conn, &frm)
 }
 
+func encodeHello(conn *Conn, info *PeerInfo, rerr *RemoteError) error {
+	frm := frame{
+		Type: HELLO,
+	}
+	if rerr != nil {
+		frm.Error = rerr.Message
+		frm.Code = int32(rerr.Code)
+		frm.Details = rerr.Details
+	} else {
+		frm.Payload = encodeBytes(info)
+	}
+	return sendFrame(conn, &frm)
+}
+
+func decodeHello(frm *frame) (*PeerInfo, error) {
+	var info PeerInfo
+	if err := decodeResponse(frm, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func encodeAuth(conn *Conn, scheme string, payload []byte, errString string) error {
+	frm := frame{
+		Type: AUTH,
+		Method: scheme,
+		Payload: payload,
+		Error: errString,
+	}
+
+	return sendFrame(conn, &frm)
+}
+
+func encodeBytes(v interface{}) []byte {
+	buf := bytes.Buffer{}
+	enc := codec.NewEncoder(&buf, &mph)
+	enc.Encode(v)
+	enc.Release()
+	return buf.Bytes()
+}
+
+func decodeBytes(b []byte, v interface{}) error {
+	dec := codec.NewDecoder(bytes.NewBuffer(b), &mph)
+	return dec.Decode(v)
+}
+
 func decodeResponse(frm *frame, v interface{}) error {
 	bb := bytes.NewBuffer(frm.Payload)
 	dec := codec.NewDecoder(bb, &mph)
@@ -1,19 +1,20 @@
 package armie
 
 import (
+	"crypto/tls"
 	"net"
 	"io"
 )
 
 type tcpTransport struct {}
 
-func (tcpTransport) Dial(address string) (*transportConn, error) {
+func (tcpTransport) Dial(address string) (*TransportConn, error) {
 	sock, err := net.Dial("tcp", address)
 	if err != nil {
 		return nil, err
 	}
 
-	return &transportConn{
+	return &TransportConn{
 		Socket: sock,
 		Address: address,
 	}, nil
@@ -23,14 +24,101 @@ func (tcpTransport) Listen(address string) (net.Listener, error) {
 	return net.Listen("tcp", address)
 }
 
+//
+// The TCP Transport.  Addresses are host:port.
+//
+func TCPTransport() Transport {
+	return &tcpTransport{}
+}
+
 func NewTCPServer(logout io.Writer) *Server {
-	return newServer(logout, &tcpTransport{})
+	return NewServer(TCPTransport(), &Options{Logger: logout})
 }
 
 func NewTCPConnection(addr string, logout io.Writer, handler ConnectionHandler) (*Conn, error) {
-	conn, err := tcpTransport{}.Dial(addr)
+	return Dial(TCPTransport(), addr, &Options{Logger: logout, ConnectionHandler: handler})
+}
+
+type unixTransport struct {}
+
+func (unixTransport) Dial(address string) (*TransportConn, error) {
+	sock, err := net.Dial("unix", address)
 	if err != nil {
 		return nil, err
 	}
-	return newConn(conn, logout, handler)
-}
\ No newline at end of file
+
+	return &TransportConn{
+		Socket: sock,
+		Address: address,
+	}, nil
+}
+
+func (unixTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("unix", address)
+}
+
+//
+// The Unix domain socket Transport.  Addresses are socket paths.
+//
+func UnixTransport() Transport {
+	return &unixTransport{}
+}
+
+//
+// Create a Server that listens on a Unix domain socket.  The address
+// passed to Listen is the socket path, which is removed on Close.
+//
+func NewUnixServer(logout io.Writer) *Server {
+	return NewServer(UnixTransport(), &Options{Logger: logout})
+}
+
+func NewUnixConnection(path string, logout io.Writer, handler ConnectionHandler) (*Conn, error) {
+	return Dial(UnixTransport(), path, &Options{Logger: logout, ConnectionHandler: handler})
+}
+
+type tlsTransport struct {
+	config *tls.Config
+}
+
+func (t *tlsTransport) Dial(address string) (*TransportConn, error) {
+	sock, err := tls.Dial("tcp", address, t.config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TransportConn{
+		Socket: sock,
+		Address: address,
+	}, nil
+}
+
+func (t *tlsTransport) Listen(address string) (net.Listener, error) {
+	return tls.Listen("tcp", address, t.config)
+}
+
+//
+// The TLS-over-TCP Transport.  Addresses are host:port.  See
+// NewTLSServer and NewTLSConnection for config requirements.
+//
+func TLSTransport(config *tls.Config) Transport {
+	return &tlsTransport{config}
+}
+
+//
+// Create a Server that accepts TLS connections.  config must carry
+// at least one certificate.  For mutual authentication set
+// config.ClientAuth (e.g. tls.RequireAndVerifyClientCert) and
+// config.ClientCAs; the verified client chain is then available
+// from Conn.VerifiedChains().
+//
+func NewTLSServer(config *tls.Config, logout io.Writer) *Server {
+	return NewServer(TLSTransport(config), &Options{Logger: logout})
+}
+
+//
+// Dial a TLS connection.  To present a client certificate, set
+// config.Certificates.
+//
+func NewTLSConnection(addr string, config *tls.Config, logout io.Writer, handler ConnectionHandler) (*Conn, error) {
+	return Dial(TLSTransport(config), addr, &Options{Logger: logout, ConnectionHandler: handler})
+}
@@ -0,0 +1,108 @@
+package armie
+
+import (
+	"context"
+	"fmt"
+)
+
+//
+// TypedFuture wraps a Future whose result decodes as T.
+//
+type TypedFuture[T any] struct {
+	future *Future
+	method string
+}
+
+//
+// Wrap an existing Future.  method is used in decode errors.
+//
+func NewTypedFuture[T any](f *Future, method string) *TypedFuture[T] {
+	return &TypedFuture[T]{f, method}
+}
+
+//
+// The underlying Future.
+//
+func (tf *TypedFuture[T]) Future() *Future {
+	return tf.future
+}
+
+//
+// Await the result.  A result that cannot be decoded as T is
+// reported as an error rather than a zero value.
+//
+func (tf *TypedFuture[T]) Get() (T, error) {
+	return tf.GetContext(context.Background())
+}
+
+//
+// Await the result, giving up when ctx is done as in
+// Future.GetResultContext.
+//
+func (tf *TypedFuture[T]) GetContext(ctx context.Context) (T, error) {
+	var res T
+	err := tf.future.GetResultContext(ctx, &res)
+	if err != nil && tf.future.err == nil {
+		var zero T
+		return zero, fmt.Errorf("decoding result of %s as %T: %w", tf.method, res, err)
+	}
+	return res, err
+}
+
+//
+// Send a request whose result decodes as T.
+//
+func Send[T any](conn Requester, method string, args ...interface{}) (*TypedFuture[T], error) {
+	return SendContext[T](context.Background(), conn, method, args...)
+}
+
+//
+// Send a request whose result decodes as T, bound to ctx as in
+// Conn.SendRequestContext.
+//
+func SendContext[T any](ctx context.Context, conn Requester, method string, args ...interface{}) (*TypedFuture[T], error) {
+	f, err := conn.SendRequestContext(ctx, method, args...)
+	if err != nil {
+		return nil, err
+	}
+	return NewTypedFuture[T](f, method), nil
+}
+
+//
+// Call method and await its result:
+//
+//	age, err := armie.Call[int](conn, "HELLO", &joe)
+//
+func Call[T any](conn Requester, method string, args ...interface{}) (T, error) {
+	return CallContext[T](context.Background(), conn, method, args...)
+}
+
+//
+// Call method and await its result, giving up when ctx is done.
+//
+func CallContext[T any](ctx context.Context, conn Requester, method string, args ...interface{}) (T, error) {
+	tf, err := SendContext[T](ctx, conn, method, args...)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return tf.GetContext(ctx)
+}
+
+//
+// Adapt a handler taking a decoded payload to an EventHandler.
+// Events whose payload cannot be decoded as T are passed to onError,
+// or dropped if onError is nil.
+//
+func TypedEventHandler[T any](handler func(event *Event, data T), onError func(event *Event, err error)) EventHandler {
+	return func(event *Event) {
+		var data T
+		if err := event.Decode(&data); err != nil {
+			if onError != nil {
+				onError(event, fmt.Errorf("decoding %s event as %T: %w", event.Event, data, err))
+			}
+			return
+		}
+		handler(event, data)
+	}
+}
@@ -0,0 +1,246 @@
+package armie
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//
+// The WebSocket transport carries frames in binary WebSocket
+// messages, so browsers and clients behind HTTP-only proxies can
+// speak the same Request / Response / Event protocol.  Addresses are
+// URLs, e.g. ws://host:9999/rpc; Dial also accepts wss:// URLs.
+//
+type wsTransport struct {
+	dialer *websocket.Dialer
+}
+
+//
+// The WebSocket Transport.  dialer configures outgoing connections
+// (TLS, proxies, handshake timeout) and may be nil for the default.
+// Listen serves plain HTTP on the host and path of the URL; to serve
+// over HTTPS or on an existing mux, use a WebSocketListener with
+// Server.ListenOn instead.
+//
+func WebSocketTransport(dialer *websocket.Dialer) Transport {
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	return &wsTransport{dialer}
+}
+
+func (t *wsTransport) Dial(address string) (*TransportConn, error) {
+	ws, _, err := t.dialer.Dial(address, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TransportConn{
+		Socket:  newWSConn(ws),
+		Address: address,
+	}, nil
+}
+
+func (t *wsTransport) Listen(address string) (net.Listener, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" {
+		return nil, fmt.Errorf("cannot listen on %q: scheme must be ws", address)
+	}
+
+	tcp, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+
+	l := NewWebSocketListener()
+	l.addr = tcp.Addr()
+	mux := http.NewServeMux()
+	mux.Handle(path, l)
+	l.srv = &http.Server{Handler: mux}
+	go l.srv.Serve(tcp)
+
+	return l, nil
+}
+
+func NewWebSocketServer(logout io.Writer) *Server {
+	return NewServer(WebSocketTransport(nil), &Options{Logger: logout})
+}
+
+func NewWebSocketConnection(url string, logout io.Writer, handler ConnectionHandler) (*Conn, error) {
+	return Dial(WebSocketTransport(nil), url, &Options{Logger: logout, ConnectionHandler: handler})
+}
+
+//
+// WebSocketListener is an http.Handler that upgrades requests to
+// WebSockets and hands them to Accept, so it can be mounted on an
+// existing mux and passed to Server.ListenOn:
+//
+//	ln := armie.NewWebSocketListener()
+//	mux.Handle("/rpc", ln)
+//	server.ListenOn(ln)
+//
+// Set Upgrader.CheckOrigin to admit cross-origin browser clients.
+//
+type WebSocketListener struct {
+	Upgrader websocket.Upgrader
+	conns    chan net.Conn
+	closed   chan struct{}
+	once     sync.Once
+	addr     net.Addr
+	srv      *http.Server
+}
+
+func NewWebSocketListener() *WebSocketListener {
+	return &WebSocketListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *WebSocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-l.closed:
+		http.Error(w, "listener closed", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
+	// Upgrade replies with an HTTP error itself on failure
+	ws, err := l.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	select {
+	case l.conns <- newWSConn(ws):
+	case <-l.closed:
+		ws.Close()
+	}
+}
+
+func (l *WebSocketListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *WebSocketListener) Close() error {
+	err := net.ErrClosed
+	l.once.Do(func() {
+		close(l.closed)
+		err = nil
+		if l.srv != nil {
+			err = l.srv.Close()
+		}
+	})
+	return err
+}
+
+func (l *WebSocketListener) Addr() net.Addr {
+	if l.addr != nil {
+		return l.addr
+	}
+	return pipeAddr("websocket")
+}
+
+//
+// wsConn adapts a WebSocket to the byte stream Conn expects.  Each
+// Write is sent as one binary message; Read drains messages in order.
+// Conn sends each frame with a single WriteMessage, so peers that are
+// not stream-based, like browsers, can decode one frame per message.
+//
+type wsConn struct {
+	ws *websocket.Conn
+	r  io.Reader
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+	return &wsConn{ws: ws}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.r == nil {
+			mt, r, err := c.ws.NextReader()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return 0, io.EOF
+			}
+			if err != nil {
+				return 0, err
+			}
+			if mt != websocket.BinaryMessage {
+				continue
+			}
+			c.r = r
+		}
+
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	err := c.WriteMessage(p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) WriteMessage(p []byte) error {
+	return c.ws.WriteMessage(websocket.BinaryMessage, p)
+}
+
+func (c *wsConn) Close() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}